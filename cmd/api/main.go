@@ -5,6 +5,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/go-redis/redis"
 
@@ -19,7 +22,22 @@ var (
 	redisDb     = flag.Int("redis-db", 0, "redis database")
 	redisDoneCh = flag.String("redis-done-chan", "processed", "redis image done processing channel")
 	basepath    = flag.String("basepath", "images", "path for local images")
+	watermarks  = flag.String("watermarks", "watermarks", "path for watermark images")
+	fonts       = flag.String("fonts", "fonts", "path for TTF and OTF fonts of text overlays")
 	timeout     = flag.Int("timeout", 2000, "timeout for image processing")
+	quality     = flag.Int("quality", internal.DefaultEncodingPolicy.Quality, "default encoder quality of lossy formats")
+	minQuality  = flag.Int("min-quality", internal.DefaultEncodingPolicy.MinQuality, "minimum encoder quality clients may ask for")
+	maxQuality  = flag.Int("max-quality", internal.DefaultEncodingPolicy.MaxQuality, "maximum encoder quality clients may ask for")
+	progressive = flag.Bool("progressive", internal.DefaultEncodingPolicy.Progressive, "encode JPEGs progressively by default; the vips resizer can't, and hands them over to the go one")
+	strip       = flag.Bool("strip", internal.DefaultEncodingPolicy.Strip, "strip EXIF and ICC metadata by default")
+	presetsPath = flag.String("presets", "", "JSON file of named presets, reloaded on SIGHUP")
+	negotiate   = flag.String("negotiate-formats", "", "comma separated formats to negotiate from the Accept header, in order of preference (e.g. webp,png); they must be encodable by the resizer backends")
+	maxWidth    = flag.Int("max-width", internal.DefaultSizePolicy.MaxWidth, "maximum width of derivatives, 0 for unbounded")
+	maxHeight   = flag.Int("max-height", internal.DefaultSizePolicy.MaxHeight, "maximum height of derivatives, 0 for unbounded")
+	maxPixels   = flag.Int("max-pixels", internal.DefaultSizePolicy.MaxPixels, "maximum width x height of derivatives, 0 for unbounded")
+	upscale     = flag.String("upscale", string(internal.DefaultSizePolicy.Upscale), "what to do with requests enlarging the original: allow, reject or clamp")
+	sizes       = flag.String("sizes", "", "comma separated allow-list of sizes (e.g. 320x,640x,300x200); any size is allowed when empty")
+	sizeMode    = flag.String("size-mode", string(internal.SizeModeSnap), "what to do with sizes out of the allow-list: snap them up to the nearest one, or strict")
 )
 
 func main() {
@@ -52,7 +70,81 @@ func main() {
 	fileWatchingWorker := internal.NewFileWatchingWorker(queue, store, ackbus, *basepath)
 	go fileWatchingWorker.Do()
 
-	svc := internal.NewService(queue, store, ackbus, *timeout)
+	var negotiatedFormats []internal.Format
+	for _, f := range strings.Split(*negotiate, ",") {
+		if f == "" {
+			continue
+		}
+		format, err := internal.ParseFormat(f)
+		if err != nil {
+			log.Fatalf("failed to parse negotiated formats: %s", err)
+		}
+		if !format.Encodable() {
+			log.Fatalf("failed to parse negotiated formats: %s: %s", format, internal.ErrUnsupportedFormat)
+		}
+		negotiatedFormats = append(negotiatedFormats, format)
+	}
+
+	encodingPolicy := internal.EncodingPolicy{
+		Quality:     *quality,
+		MinQuality:  *minQuality,
+		MaxQuality:  *maxQuality,
+		Progressive: *progressive,
+		Strip:       *strip,
+	}
+
+	upscalePolicy, err := internal.ParseUpscale(*upscale)
+	if err != nil {
+		log.Fatalf("failed to parse the upscale policy: %s", err)
+	}
+	sizePolicy := internal.SizePolicy{
+		MaxWidth:  *maxWidth,
+		MaxHeight: *maxHeight,
+		MaxPixels: *maxPixels,
+		Upscale:   upscalePolicy,
+	}
+
+	mode, err := internal.ParseSizeMode(*sizeMode)
+	if err != nil {
+		log.Fatalf("failed to parse the size mode: %s", err)
+	}
+	sizeBuckets, err := internal.ParseSizeBuckets(*sizes, mode)
+	if err != nil {
+		log.Fatalf("failed to parse the allowed sizes: %s", err)
+	}
+
+	watermarkDir := internal.NewWatermarks(*watermarks)
+	fontDir := internal.NewFonts(*fonts)
+
+	var presets *internal.Presets
+	if *presetsPath != "" {
+		presets, err = internal.LoadPresets(*presetsPath, watermarkDir, fontDir, sizePolicy, sizeBuckets)
+		if err != nil {
+			log.Fatalf("failed to load presets: %s", err)
+		}
+
+		// Reload presets on SIGHUP, keeping the current ones when the file is invalid
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go func() {
+			for range hupCh {
+				if err := presets.Reload(); err != nil {
+					log.Printf("failed to reload presets: %s\n", err)
+					continue
+				}
+				log.Printf("reloaded presets from: %s", *presetsPath)
+			}
+		}()
+	}
+
+	svc := internal.NewService(queue, store, ackbus, *timeout,
+		internal.WithNegotiatedFormats(negotiatedFormats),
+		internal.WithEncodingPolicy(encodingPolicy),
+		internal.WithSizePolicy(sizePolicy),
+		internal.WithSizeBuckets(sizeBuckets),
+		internal.WithPresets(presets),
+		internal.WithWatermarks(watermarkDir),
+		internal.WithFonts(fontDir))
 	log.Printf("starting http server on: %s", *addr)
 	log.Fatalf("http server crashed: %s", http.ListenAndServe(*addr, svc))
 }
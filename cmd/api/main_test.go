@@ -6,9 +6,11 @@ import (
 	"github.com/conves/imgrsz/internal"
 	"image/jpeg"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"testing"
 
 	"github.com/go-redis/redis"
@@ -92,6 +94,21 @@ func Test_getImage(t *testing.T) {
 		}
 	}
 
+	// Byte budget on a lossless format
+	{
+		req, err := http.NewRequest(http.MethodGet, "/image/beautiful_landscape_1.jpg?size=150x150&format=png&maxbytes=1000", nil)
+		if err != nil {
+			t.Errorf("error creating request: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+
+		if e, a := http.StatusBadRequest, w.Code; e != a {
+			t.Errorf("expected status code: %v, got status code: %v", e, a)
+		}
+	}
+
 	// Found original image
 	{
 		req, err := http.NewRequest(http.MethodGet, "/image/beautiful_landscape_1.jpg", nil)
@@ -115,7 +132,7 @@ func Test_getImage(t *testing.T) {
 		height := 150
 		req, err := http.NewRequest(
 			http.MethodGet,
-			fmt.Sprintf("/image/beautiful_landscape_1.jpg?size=%dx%d", width, height),
+			fmt.Sprintf("/image/beautiful_landscape_1.jpg?size=%dx%d&fit=cover", width, height),
 			nil)
 		if err != nil {
 			t.Errorf("error creating request: %v", err)
@@ -136,9 +153,9 @@ func Test_getImage(t *testing.T) {
 			t.Errorf("expected width: %v, got widht: %v", width, img.Width)
 		}
 
-		//if height != img.Height {
-		//	t.Errorf("expected height: %v, got height: %v", height, img.Height)
-		//}
+		if height != img.Height {
+			t.Errorf("expected height: %v, got height: %v", height, img.Height)
+		}
 
 		lastModified = w.Header().Get("Last-Modified")
 		if lastModified == "" {
@@ -146,13 +163,54 @@ func Test_getImage(t *testing.T) {
 		}
 	}
 
+	// Width only resized image
+	{
+		original, err := os.Open(path.Join(*basepath, "beautiful_landscape_1.jpg"))
+		if err != nil {
+			t.Fatalf("failed to open original image: %s", err)
+		}
+		defer original.Close()
+		originalCfg, err := jpeg.DecodeConfig(original)
+		if err != nil {
+			t.Fatalf("failed to decode original image: %s", err)
+		}
+
+		width := 120
+		height := int(math.Round(float64(width) * float64(originalCfg.Height) / float64(originalCfg.Width)))
+		req, err := http.NewRequest(
+			http.MethodGet,
+			fmt.Sprintf("/image/beautiful_landscape_1.jpg?size=%dx", width),
+			nil)
+		if err != nil {
+			t.Errorf("error creating request: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+
+		if e, a := http.StatusOK, w.Code; e != a {
+			t.Errorf("expected status code: %v, got status code: %v", e, a)
+		}
+
+		img, err := jpeg.DecodeConfig(w.Body)
+		if err != nil {
+			t.Errorf("failed to decode received image: %s", err)
+		}
+		if width != img.Width {
+			t.Errorf("expected width: %v, got width: %v", width, img.Width)
+		}
+		if height != img.Height {
+			t.Errorf("expected height: %v, got height: %v", height, img.Height)
+		}
+	}
+
 	// Cached image
 	{
 		width := 150
 		height := 150
 		req, err := http.NewRequest(
 			http.MethodGet,
-			fmt.Sprintf("/image/beautiful_landscape_1.jpg?size=%dx%d", width, height),
+			fmt.Sprintf("/image/beautiful_landscape_1.jpg?size=%dx%d&fit=cover", width, height),
 			nil)
 		if err != nil {
 			t.Errorf("error creating request: %v", err)
@@ -9,7 +9,6 @@ import (
 	"path"
 	"time"
 
-	"github.com/daddye/vips"
 	"github.com/go-redis/redis"
 
 	"github.com/conves/imgrsz/internal"
@@ -22,7 +21,15 @@ var (
 	redisDb     = flag.Int("redis-db", 0, "redis database")
 	redisDoneCh = flag.String("redis-done-chan", "processed", "redis image done processing channel")
 	workers     = flag.Int("workers", 3, "number of workers")
+	palettes    = flag.Int("palette-workers", 1, "number of workers computing color palettes")
 	basepath    = flag.String("basepath", "images", "path for local images")
+	watermarks  = flag.String("watermarks", "watermarks", "path for watermark images")
+	fonts       = flag.String("fonts", "fonts", "path for TTF and OTF fonts of text overlays")
+	backend     = flag.String("resizer", "go", "image resizing backend (go, or vips when built with the vips tag)")
+	maxWidth    = flag.Int("max-width", internal.DefaultSizePolicy.MaxWidth, "maximum width of derivatives, 0 for unbounded")
+	maxHeight   = flag.Int("max-height", internal.DefaultSizePolicy.MaxHeight, "maximum height of derivatives, 0 for unbounded")
+	maxPixels   = flag.Int("max-pixels", internal.DefaultSizePolicy.MaxPixels, "maximum width x height of derivatives, 0 for unbounded")
+	upscale     = flag.String("upscale", string(internal.DefaultSizePolicy.Upscale), "what to do with requests enlarging the original: allow, reject or clamp")
 )
 
 func main() {
@@ -46,6 +53,24 @@ func main() {
 
 	// client.FlushDB()
 
+	resizer, err := internal.NewResizer(*backend,
+		internal.WithResizerWatermarks(internal.NewWatermarks(*watermarks)),
+		internal.WithResizerFonts(internal.NewFonts(*fonts)))
+	if err != nil {
+		log.Fatalf("failed to set up the resizer: %s", err)
+	}
+
+	upscalePolicy, err := internal.ParseUpscale(*upscale)
+	if err != nil {
+		log.Fatalf("failed to parse the upscale policy: %s", err)
+	}
+	sizePolicy := internal.SizePolicy{
+		MaxWidth:  *maxWidth,
+		MaxHeight: *maxHeight,
+		MaxPixels: *maxPixels,
+		Upscale:   upscalePolicy,
+	}
+
 	ackbus := internal.NewRedisImageProcessedAckBus(client, *redisDoneCh)
 	defer ackbus.Close()
 
@@ -54,7 +79,12 @@ func main() {
 
 	// Start image processing workers
 	for i := 0; i < *workers; i++ {
-		go worker{queue: queue, store: store, ackbus: ackbus, basepath: *basepath}.do()
+		go worker{queue: queue, store: store, ackbus: ackbus, resizer: resizer, sizePolicy: sizePolicy, basepath: *basepath}.do()
+	}
+
+	// Start palette workers
+	for i := 0; i < *palettes; i++ {
+		go paletteWorker{queue: queue, store: store, ackbus: ackbus, basepath: *basepath}.do()
 	}
 
 	// Wait for signal interrupt
@@ -65,10 +95,12 @@ func main() {
 
 // worker process images to be resized
 type worker struct {
-	queue    internal.ProcessingQueue
-	store    internal.ImageStore
-	ackbus   internal.ImageProcessedAckBus
-	basepath string
+	queue      internal.ProcessingQueue
+	store      internal.ImageStore
+	ackbus     internal.ImageProcessedAckBus
+	resizer    internal.Resizer
+	sizePolicy internal.SizePolicy
+	basepath   string
 }
 
 func (w worker) do() {
@@ -88,33 +120,44 @@ func (w worker) do() {
 			}
 
 			defer func() {
-				if err != nil {
-					if err = w.queue.PriorityEnqueue(img); err != nil {
-						log.Printf("failed to re-enqueue an image for processing: %s\n", err)
+				if err == nil {
+					return
+				}
+				// Clients waiting for an image that will never come are told why
+				if internal.IsPermanent(err) {
+					if err = w.ackbus.SendFailure(img.Name(), err); err != nil {
+						log.Printf("error saving an ack msg: %s\n", err)
 					}
+					return
+				}
+				if err = w.queue.PriorityEnqueue(img); err != nil {
+					log.Printf("failed to re-enqueue an image for processing: %s\n", err)
 				}
 			}()
 
 			// Resize image
-			var file *os.File
+			var inBuf, buf []byte
+			var quality int
 
-			file, err = os.Open(path.Join(w.basepath, img.Original))
+			inBuf, err = ioutil.ReadFile(path.Join(w.basepath, img.Original))
 			if err != nil {
-				log.Printf("failed to open image for resizing: %s\n", err)
+				log.Printf("failed to read image content: %s\n", err)
 				return
 			}
-			inBuf, err := ioutil.ReadAll(file)
+
+			// The API checks requests already; the queue is not trusted with the memory of workers though
+			var width, height int
+			width, height, err = internal.SourceSize(inBuf, img)
 			if err != nil {
-				log.Printf("failed to read image content: %s\n", err)
+				log.Printf("failed to read the size of an image: %s\n", err)
 				return
 			}
-			options := vips.Options{
-				Width:   img.Width,
-				Height:  img.Height,
-				Quality: 100,
-				Format:  vips.JPEG,
+			if err = w.sizePolicy.Validate(img, width, height); err != nil {
+				log.Printf("dropping an image out of the size policy: %s\n", err)
+				return
 			}
-			buf, err := vips.Resize(inBuf, options)
+
+			buf, quality, err = internal.ResizeWithinBudget(w.resizer, inBuf, img)
 			if err != nil {
 				log.Printf("failed to resize image: %s\n", err)
 				return
@@ -125,9 +168,63 @@ func (w worker) do() {
 				log.Printf("error saving an image: %s\n", err)
 			}
 
+			// Record the quality a byte budget settled on
+			if img.MaxBytes > 0 && quality > 0 {
+				if err = w.store.SaveQuality(img, quality); err != nil {
+					log.Printf("error saving the quality of an image: %s\n", err)
+				}
+			}
+
 			if err = w.ackbus.Send(img.Name()); err != nil {
 				log.Printf("error saving an ack msg: %s\n", err)
 			}
 		}()
 	}
 }
+
+// paletteWorker computes the color palettes of originals
+type paletteWorker struct {
+	queue    internal.ProcessingQueue
+	store    internal.ImageStore
+	ackbus   internal.ImageProcessedAckBus
+	basepath string
+}
+
+func (w paletteWorker) do() {
+	for {
+		job, err := w.queue.DequeuePalette()
+		if err == internal.ErrNil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			log.Printf("failed to deque a palette job: %s\n", err)
+			continue
+		}
+
+		// Failures aren't retried: the original is unreadable, or not an image
+		inBuf, err := ioutil.ReadFile(path.Join(w.basepath, job.Original))
+		if err != nil {
+			log.Printf("failed to read image content: %s\n", err)
+			continue
+		}
+
+		palette, err := internal.NewPalette(inBuf, job.Count)
+		if err != nil {
+			log.Printf("failed to compute a palette: %s\n", err)
+			if err = w.ackbus.SendFailure(job.Key(), err); err != nil {
+				log.Printf("error saving an ack msg: %s\n", err)
+			}
+			continue
+		}
+
+		if err = w.store.SavePalette(job, palette); err != nil {
+			log.Printf("error saving a palette: %s\n", err)
+			continue
+		}
+
+		if err = w.ackbus.Send(job.Key()); err != nil {
+			log.Printf("error saving an ack msg: %s\n", err)
+		}
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/conves/imgrsz
 
-go 1.13
+go 1.18
 
 require (
 	github.com/ReneKroon/ttlcache v1.6.0
@@ -9,4 +9,16 @@ require (
 	github.com/gorilla/mux v1.7.3
 	github.com/peterbourgon/ff v1.6.0
 	github.com/prometheus/client_golang v1.2.1
+	golang.org/x/image v0.18.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.0 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4 // indirect
+	github.com/prometheus/common v0.7.0 // indirect
+	github.com/prometheus/procfs v0.0.5 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
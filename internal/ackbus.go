@@ -3,6 +3,7 @@ package internal
 import (
 	"context"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/ReneKroon/ttlcache"
@@ -11,10 +12,23 @@ import (
 
 type ImageProcessedAckBus interface {
 	Send(key string) error
+	SendFailure(key string, reason error) error // acknowledges a task the workers gave up on for good
 	Receive(ctx context.Context, key string) error
 	Close()
 }
 
+// ackSeparator splits the reason of a failure from the key it is reported for; file names can't contain it
+const ackSeparator = "\x00"
+
+// processingError is what receivers get for the tasks the workers gave up on, with the reason why
+type processingError struct {
+	reason string
+}
+
+func (e processingError) Error() string {
+	return e.reason
+}
+
 type RedisImageProcessedAckBus struct {
 	client     *redis.Client
 	pubsub     *redis.PubSub
@@ -29,9 +43,17 @@ func (r RedisImageProcessedAckBus) Close() {
 }
 
 func (r RedisImageProcessedAckBus) Send(key string) error {
-	err := r.client.Publish(r.pubsubchan, key).Err()
+	return r.publish(key, key)
+}
+
+func (r RedisImageProcessedAckBus) SendFailure(key string, reason error) error {
+	return r.publish(key, key+ackSeparator+reason.Error())
+}
+
+func (r RedisImageProcessedAckBus) publish(key, payload string) error {
+	err := r.client.Publish(r.pubsubchan, payload).Err()
 	if _, ok := r.ackcache.Get(key); !ok {
-		r.ackcache.SetWithTTL(key, make(chan struct{}, 1), r.acksttl)
+		r.ackcache.SetWithTTL(key, make(chan string, 1), r.acksttl)
 	}
 	return err
 }
@@ -39,16 +61,19 @@ func (r RedisImageProcessedAckBus) Send(key string) error {
 func (r RedisImageProcessedAckBus) Receive(ctx context.Context, key string) error {
 	// Because receive() can occur before send()
 	if _, ok := r.ackcache.Get(key); !ok {
-		r.ackcache.SetWithTTL(key, make(chan struct{}, 1), r.acksttl)
+		r.ackcache.SetWithTTL(key, make(chan string, 1), r.acksttl)
 	}
 
 	ch, _ := r.ackcache.Get(key)
-	recvch := ch.(chan struct{})
+	recvch := ch.(chan string)
 
 	select {
 	case <-ctx.Done():
 		return errors.New("context deadline")
-	case <-recvch:
+	case reason := <-recvch:
+		if reason != "" {
+			return processingError{reason: reason}
+		}
 	}
 	return nil
 }
@@ -63,9 +88,13 @@ func NewRedisImageProcessedAckBus(client *redis.Client, channel string) ImagePro
 		for {
 			select {
 			case m := <-recvch:
-				if ch, ok := bus.ackcache.Get(m.Payload); ok {
-					ackch := ch.(chan struct{})
-					ackch <- struct{}{}
+				key, reason := m.Payload, ""
+				if i := strings.Index(m.Payload, ackSeparator); i >= 0 {
+					key, reason = m.Payload[:i], m.Payload[i+len(ackSeparator):]
+				}
+				if ch, ok := bus.ackcache.Get(key); ok {
+					ackch := ch.(chan string)
+					ackch <- reason
 				}
 			}
 		}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+var (
+	ErrInvalidFrame     = errors.New("frame must be an integer between 0 and 9999")
+	ErrFrameOutOfBounds = errors.New("frame is out of the frames of the original")
+	errInvalidGIF       = errors.New("gif: invalid block structure")
+)
+
+// maxFrame bounds the frame parameter; longer animations can't have their last frames extracted
+const maxFrame = 9999
+
+var gifSignature = []byte("GIF8")
+
+// decodeFrames decodes what a derivative is made of: every frame of an animated GIF turned into a GIF,
+// the frame img asks for, or the only frame of other originals. Frames are composited as they're displayed
+// and handed to fn one at a time, each one a full image of its own, so that animations are never held
+// at full size; anim is only returned for derivatives that are animated.
+func decodeFrames(in []byte, img Imgmeta, fn func(frame *image.RGBA) error) (anim *gif.GIF, err error) {
+	if !bytes.HasPrefix(in, gifSignature) || img.Frame == nil && img.OutputFormat() != FormatGIF {
+		src, _, err := image.Decode(bytes.NewReader(in))
+		if err != nil {
+			return nil, decodeError{err}
+		}
+		if img.Frame != nil && *img.Frame > 0 {
+			return nil, ErrFrameOutOfBounds
+		}
+		return nil, fn(toRGBA(src))
+	}
+
+	anim, err = gif.DecodeAll(bytes.NewReader(in))
+	if err != nil {
+		return nil, decodeError{err}
+	}
+	count := len(anim.Image)
+	if img.Frame != nil {
+		if *img.Frame >= count {
+			return nil, ErrFrameOutOfBounds
+		}
+		count = *img.Frame + 1
+	}
+	err = compositeFrames(anim, count, func(i int, canvas *image.RGBA) error {
+		if img.Frame != nil && i != *img.Frame {
+			return nil
+		}
+		// The canvas goes on with the next frames
+		frame := image.NewRGBA(image.Rect(0, 0, canvas.Rect.Dx(), canvas.Rect.Dy()))
+		copy(frame.Pix, canvas.Pix)
+		return fn(frame)
+	})
+	if err != nil || img.Frame != nil || len(anim.Image) == 1 {
+		return nil, err
+	}
+	return anim, nil
+}
+
+// compositeFrames draws the first count frames of an animation onto its logical screen, following their
+// disposal methods, and hands the canvas to fn once each of them is drawn; fn must not hold on to it
+func compositeFrames(anim *gif.GIF, count int, fn func(i int, canvas *image.RGBA) error) error {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if bounds.Empty() {
+		for _, frame := range anim.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+	canvas := image.NewRGBA(bounds)
+
+	var previous []byte
+	for i, frame := range anim.Image[:count] {
+		var disposal byte
+		if i < len(anim.Disposal) {
+			disposal = anim.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = append(previous[:0], canvas.Pix...)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if err := fn(i, canvas); err != nil {
+			return err
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous)
+		}
+	}
+	return nil
+}
+
+// encodeAnimatedGIF writes frames with the delays and loop count of anim. Frames are full images, so each one
+// clears the previous; the palette of the still encoder is used, with a transparent color in place of its last one.
+func encodeAnimatedGIF(w io.Writer, frames []*image.RGBA, anim *gif.GIF) error {
+	pal := append(color.Palette{color.Transparent}, palette.Plan9[:len(palette.Plan9)-1]...)
+	out := gif.GIF{LoopCount: anim.LoopCount}
+	for i, frame := range frames {
+		paletted := image.NewPaletted(frame.Bounds(), pal)
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), frame, frame.Bounds().Min)
+		out.Image = append(out.Image, paletted)
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+		var delay int
+		if i < len(anim.Delay) {
+			delay = anim.Delay[i]
+		}
+		out.Delay = append(out.Delay, delay)
+	}
+	return gif.EncodeAll(w, &out)
+}
+
+// frameCount counts the frames of an original, 1 for anything but GIFs; the blocks of GIFs are walked over,
+// their frames aren't decoded
+func frameCount(data []byte) (int, error) {
+	if !bytes.HasPrefix(data, gifSignature) {
+		return 1, nil
+	}
+	// Header and logical screen descriptor, then the global color table
+	if len(data) < 13 {
+		return 0, errInvalidGIF
+	}
+	pos := 13 + gifColorTableSize(data[10])
+
+	var count int
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			// Extension: its label, then data sub-blocks
+			pos = skipGIFSubBlocks(data, pos+2)
+		case 0x2c:
+			// Image descriptor, local color table and LZW code size, then data sub-blocks
+			if pos+10 > len(data) {
+				return 0, errInvalidGIF
+			}
+			pos = skipGIFSubBlocks(data, pos+11+gifColorTableSize(data[pos+9]))
+			count++
+		case 0x3b:
+			return count, nil
+		default:
+			return 0, errInvalidGIF
+		}
+	}
+	// Truncated, the trailer is missing
+	return 0, errInvalidGIF
+}
+
+// gifColorTableSize reads the size in bytes of the color table the packed fields of a descriptor announce
+func gifColorTableSize(packed byte) int {
+	if packed&0x80 == 0 {
+		return 0
+	}
+	return 3 << (packed&0x07 + 1)
+}
+
+// skipGIFSubBlocks returns the position following the data sub-blocks at pos, or past the end of data
+// when they're truncated
+func skipGIFSubBlocks(data []byte, pos int) int {
+	for pos < len(data) {
+		size := int(data[pos])
+		pos++
+		if size == 0 {
+			return pos
+		}
+		pos += size
+	}
+	return len(data) + 1
+}
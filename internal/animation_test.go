@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func Test_frameCount(t *testing.T) {
+	// Local color tables and extensions, delays and loop counts among them, are walked over
+	pal := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{LoopCount: 1}
+	for i := 0; i < 5; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 30, 20), pal)
+		if i%2 == 1 {
+			frame = image.NewPaletted(image.Rect(0, 0, 30, 20), color.Palette{color.White, color.Black, color.Transparent})
+		}
+		frame.Pix[i] = 1
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var in bytes.Buffer
+	if err := gif.EncodeAll(&in, anim); err != nil {
+		t.Fatalf("failed to encode animation: %s", err)
+	}
+
+	tests := []struct {
+		data     []byte
+		expected int
+		err      error
+	}{
+		{in.Bytes(), 5, nil},
+		{in.Bytes()[:in.Len()-1], 0, errInvalidGIF},
+		{in.Bytes()[:in.Len()/2], 0, errInvalidGIF},
+		{testImage(t, 40, 20), 1, nil},
+	}
+
+	for _, tt := range tests {
+		count, err := frameCount(tt.data)
+		if err != tt.err {
+			t.Errorf("expected error: %v, got error: %v", tt.err, err)
+			continue
+		}
+		if count != tt.expected {
+			t.Errorf("expected frames: %v, got frames: %v", tt.expected, count)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"strconv"
@@ -46,12 +47,71 @@ var (
 	}, []string{"status"})
 )
 
-func NewService(queue ProcessingQueue, store ImageStore, ackbus ImageProcessedAckBus, httpTimeout int) *Service {
+// ServiceOption configures the optional behaviours of a Service
+type ServiceOption func(svc *Service)
+
+// WithNegotiatedFormats makes the Service pick, for requests without an explicit format,
+// the first of the given formats the client accepts
+func WithNegotiatedFormats(formats []Format) ServiceOption {
+	return func(svc *Service) {
+		svc.negotiatedFormats = formats
+	}
+}
+
+// WithEncodingPolicy sets the defaults and limits of the encoder options
+func WithEncodingPolicy(policy EncodingPolicy) ServiceOption {
+	return func(svc *Service) {
+		svc.encodingPolicy = policy
+	}
+}
+
+// WithSizePolicy sets the limits on the dimensions of derivatives
+func WithSizePolicy(policy SizePolicy) ServiceOption {
+	return func(svc *Service) {
+		svc.sizePolicy = policy
+	}
+}
+
+// WithSizeBuckets restricts the sizes derivatives can be requested in
+func WithSizeBuckets(buckets SizeBuckets) ServiceOption {
+	return func(svc *Service) {
+		svc.sizeBuckets = buckets
+	}
+}
+
+// WithPresets lets clients request derivatives by preset name
+func WithPresets(presets *Presets) ServiceOption {
+	return func(svc *Service) {
+		svc.presets = presets
+	}
+}
+
+// WithWatermarks sets the directory watermarks are checked against
+func WithWatermarks(watermarks Watermarks) ServiceOption {
+	return func(svc *Service) {
+		svc.watermarks = watermarks
+	}
+}
+
+// WithFonts sets the directory the fonts of text overlays are checked against
+func WithFonts(fonts Fonts) ServiceOption {
+	return func(svc *Service) {
+		svc.fonts = fonts
+	}
+}
+
+func NewService(queue ProcessingQueue, store ImageStore, ackbus ImageProcessedAckBus, httpTimeout int,
+	opts ...ServiceOption) *Service {
 	svc := Service{
 		queue:  queue,
 		store:  store,
 		ackbus: ackbus,
 		httpTimeout: httpTimeout,
+		encodingPolicy: DefaultEncodingPolicy,
+		sizePolicy: DefaultSizePolicy,
+	}
+	for _, opt := range opts {
+		opt(&svc)
 	}
 
 	count, err := store.Count()
@@ -70,15 +130,279 @@ func NewService(queue ProcessingQueue, store ImageStore, ackbus ImageProcessedAc
 	//   required: true
 	//   type: string
 	//   format: uuid
+	// - name: preset
+	//   in: query
+	//   required: false
+	//   type: string
+	//   description: a named bundle of the other parameters, which take precedence over it
 	// - name: size
 	//   in: query
 	//   required: false
 	//   type: string
-	//   pattern: '^[0-9]+x[0-9]+$'
+	//   pattern: '^[0-9]*x[0-9]*$'
+	// - name: w
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: 1
+	// - name: h
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: 1
+	// - name: dpr
+	//   in: query
+	//   required: false
+	//   type: number
+	//   minimum: 1
+	//   maximum: 4
+	// - name: fit
+	//   in: query
+	//   required: false
+	//   type: string
+	//   enum: [contain, cover, fill, inside, outside]
+	//   default: inside
+	// - name: gravity
+	//   in: query
+	//   required: false
+	//   type: string
+	//   enum: [center, north, north-east, east, south-east, south, south-west, west, north-west, smart]
+	//   default: center
+	// - name: fp
+	//   in: query
+	//   required: false
+	//   type: string
+	//   pattern: '^[0-9.]+,[0-9.]+$'
+	// - name: frame
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: 0
+	//   maximum: 9999
+	// - name: rotate
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   enum: [90, 180, 270]
+	// - name: flip
+	//   in: query
+	//   required: false
+	//   type: string
+	//   enum: [h, v]
+	// - name: orient
+	//   in: query
+	//   required: false
+	//   type: boolean
+	//   default: true
+	// - name: crop
+	//   in: query
+	//   required: false
+	//   type: string
+	//   pattern: '^[0-9.]+%?,[0-9.]+%?,[0-9.]+%?,[0-9.]+%?$'
+	//   description: x,y,w,h region of the original, in pixels or percentages
+	// - name: pad
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: 0
+	//   maximum: 1000
+	// - name: bg
+	//   in: query
+	//   required: false
+	//   type: string
+	//   pattern: '^([0-9a-fA-F]{6}|[0-9a-fA-F]{8})$'
+	// - name: radius
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: 0
+	//   maximum: 1000
+	// - name: mask
+	//   in: query
+	//   required: false
+	//   type: string
+	//   enum: [circle]
+	// - name: grayscale
+	//   in: query
+	//   required: false
+	//   type: boolean
+	// - name: sepia
+	//   in: query
+	//   required: false
+	//   type: boolean
+	// - name: brightness
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: -100
+	//   maximum: 100
+	// - name: contrast
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: -100
+	//   maximum: 100
+	// - name: blur
+	//   in: query
+	//   required: false
+	//   type: number
+	//   minimum: 0
+	//   maximum: 10
+	// - name: sharpen
+	//   in: query
+	//   required: false
+	//   type: number
+	//   minimum: 0
+	//   maximum: 10
+	// - name: wm
+	//   in: query
+	//   required: false
+	//   type: string
+	//   description: file name of a watermark to composite onto the image
+	// - name: wmpos
+	//   in: query
+	//   required: false
+	//   type: string
+	//   enum: [center, north, north-east, east, south-east, south, south-west, west, north-west]
+	//   default: south-east
+	// - name: wmopacity
+	//   in: query
+	//   required: false
+	//   type: number
+	//   minimum: 0
+	//   maximum: 1
+	//   default: 1
+	// - name: wmmargin
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: 0
+	//   maximum: 1000
+	// - name: wmscale
+	//   in: query
+	//   required: false
+	//   type: number
+	//   minimum: 0
+	//   maximum: 1
+	// - name: text
+	//   in: query
+	//   required: false
+	//   type: string
+	//   maxLength: 100
+	// - name: font
+	//   in: query
+	//   required: false
+	//   type: string
+	//   default: go-regular
+	// - name: textsize
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: 1
+	//   maximum: 500
+	//   default: 24
+	// - name: textcolor
+	//   in: query
+	//   required: false
+	//   type: string
+	//   pattern: '^([0-9a-fA-F]{6}|[0-9a-fA-F]{8})$'
+	//   default: ffffff
+	// - name: textpos
+	//   in: query
+	//   required: false
+	//   type: string
+	//   enum: [center, north, north-east, east, south-east, south, south-west, west, north-west]
+	//   default: north-west
+	// - name: textshadow
+	//   in: query
+	//   required: false
+	//   type: string
+	//   pattern: '^([0-9a-fA-F]{6}|[0-9a-fA-F]{8})$'
+	// - name: format
+	//   in: query
+	//   required: false
+	//   type: string
+	//   enum: [jpeg, png, webp, gif]
+	//   description: without it, the format may be negotiated from the Accept header
+	// - name: q
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: 1
+	//   maximum: 100
+	// - name: progressive
+	//   in: query
+	//   required: false
+	//   type: boolean
+	// - name: strip
+	//   in: query
+	//   required: false
+	//   type: boolean
+	// - name: icc
+	//   in: query
+	//   required: false
+	//   type: string
+	//   enum: [srgb, keep]
+	//   default: srgb
+	// - name: maxbytes
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: 1
+	// - name: Accept
+	//   in: header
+	//   required: false
+	//   type: string
 	// responses:
 	//   200:
 	r.Handle("/image/{filename}", metricsMdw(http.HandlerFunc(svc.imgHandler)))
 
+	// swagger:operation GET /image/{filename}/placeholder Images Placeholder
+	// ---
+	// parameters:
+	// - name: filename
+	//   in: path
+	//   required: true
+	//   type: string
+	// - name: type
+	//   in: query
+	//   required: false
+	//   type: string
+	//   enum: [blurhash, thumbhash, lqip]
+	//   default: blurhash
+	// responses:
+	//   200:
+	r.Handle("/image/{filename}/placeholder", metricsMdw(http.HandlerFunc(svc.placeholderHandler)))
+
+	// swagger:operation GET /image/{filename}/colors Images Colors
+	// ---
+	// parameters:
+	// - name: filename
+	//   in: path
+	//   required: true
+	//   type: string
+	// - name: count
+	//   in: query
+	//   required: false
+	//   type: integer
+	//   minimum: 1
+	//   maximum: 16
+	//   default: 5
+	// responses:
+	//   200:
+	r.Handle("/image/{filename}/colors", metricsMdw(http.HandlerFunc(svc.colorsHandler)))
+
+	// swagger:operation GET /image/{filename}/info Images Info
+	// ---
+	// parameters:
+	// - name: filename
+	//   in: path
+	//   required: true
+	//   type: string
+	// responses:
+	//   200:
+	r.Handle("/image/{filename}/info", metricsMdw(http.HandlerFunc(svc.infoHandler)))
+
 	r.Handle("/metrics", promhttp.Handler())
 
 	s := http.StripPrefix("/docs/", http.FileServer(http.Dir("./../../web/swagger-ui/")))
@@ -127,28 +451,111 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // Service is the struct that contains the server handler as well as
 // any references to services that the Service needs.
 type Service struct {
-	queue       ProcessingQueue
-	store       ImageStore
-	ackbus      ImageProcessedAckBus
-	handler     http.Handler
-	httpTimeout int
+	queue             ProcessingQueue
+	store             ImageStore
+	ackbus            ImageProcessedAckBus
+	handler           http.Handler
+	httpTimeout       int
+	negotiatedFormats []Format
+	encodingPolicy    EncodingPolicy
+	sizePolicy        SizePolicy
+	sizeBuckets       SizeBuckets
+	presets           *Presets
+	watermarks        Watermarks
+	fonts             Fonts
 }
 
 func (svc *Service) imgHandler(rw http.ResponseWriter, req *http.Request) {
-	var sizeStr string
-	size, ok := req.URL.Query()["size"]
-	if !ok || len(size[0]) < 1 {
-		sizeStr = ""
-	} else {
-		sizeStr = size[0]
+	query, err := svc.presets.Expand(req.URL.Query())
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
 	}
-	img, err := NewImageFromRequest(mux.Vars(req)["filename"], sizeStr)
+
+	img, err := NewImageFromRequest(mux.Vars(req)["filename"], query)
 	if err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("size must be formatted as 123x123"))
+		rw.Write([]byte(err.Error()))
 		return
 	}
 
+	if img.Watermark != nil && !svc.watermarks.Has(img.Watermark.Name) {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(ErrUnknownWatermark.Error()))
+		return
+	}
+
+	if img.Text != nil && !svc.fonts.Has(img.Text.Font) {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(ErrUnknownFont.Error()))
+		return
+	}
+
+	// Pick the output format of derivatives from the Accept header, unless the client asked for one;
+	// originals are served as they are, and GIFs keep their format, animations don't survive the conversion
+	if len(svc.negotiatedFormats) > 0 && query.Get("format") == "" && !img.IsOriginal &&
+		FormatFromFilename(img.Original) != FormatGIF {
+		// Whether a format is picked or not, the response depends on the header
+		rw.Header().Add("Vary", "Accept")
+		if format := NegotiateFormat(req.Header.Get("Accept"), svc.negotiatedFormats); format != "" {
+			img = img.WithFormat(format)
+		}
+	}
+
+	// Originals the resizers can't write the format of need another format
+	if !img.IsOriginal && !img.OutputFormat().Encodable() {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(ErrUnsupportedFormat.Error()))
+		return
+	}
+
+	// Lossless formats can't trade quality for size, their budgets would never be met
+	if img.MaxBytes > 0 && !img.OutputFormat().Lossy() {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(ErrLosslessMaxBytes.Error()))
+		return
+	}
+
+	img, err = svc.sizeBuckets.Apply(img)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	// Width or height only: the other dimension follows the aspect ratio of the original, or of its crop;
+	// crops are checked against the original too
+	var origW, origH int
+	if img.HasPartialSize() || img.Crop != nil || svc.sizePolicy.NeedsOriginalSize(img) {
+		origW, origH, err = svc.store.Size(img)
+		if err == ErrOriginalNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte("not found"))
+			return
+		}
+		if err == ErrCropOutOfBounds {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			log.Printf("failed to read the size of an original: %s\n", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		img = img.WithOriginalSize(origW, origH)
+	}
+
+	img, err = svc.sizePolicy.Apply(img, origW, origH)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	img = svc.encodingPolicy.Apply(img, query)
+
 	// Check image existence and handle failure
 	isCached, err := svc.store.Has(img)
 	if err == ErrOriginalNotFound {
@@ -163,6 +570,21 @@ func (svc *Service) imgHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	if !isCached {
+		// Frames are only counted for derivatives that are yet to be made
+		if img.Frame != nil {
+			count, err := svc.store.FrameCount(img.Original)
+			if err != nil {
+				log.Printf("failed to count the frames of an original: %s\n", err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if *img.Frame >= count {
+				rw.WriteHeader(http.StatusBadRequest)
+				rw.Write([]byte(ErrFrameOutOfBounds.Error()))
+				return
+			}
+		}
+
 		cacheMisses.Add(1)
 		// Enqueue an image resizing task
 		if err := svc.queue.Enqueue(img); err != nil {
@@ -175,6 +597,11 @@ func (svc *Service) imgHandler(rw http.ResponseWriter, req *http.Request) {
 		defer cancel()
 
 		err = svc.ackbus.Receive(ctx, img.Name())
+		if _, ok := err.(processingError); ok {
+			rw.WriteHeader(http.StatusUnprocessableEntity)
+			rw.Write([]byte(err.Error()))
+			return
+		}
 		if err != nil {
 			log.Printf("failed to receive a processed image: %s\n", err)
 			rw.WriteHeader(http.StatusServiceUnavailable)
@@ -192,3 +619,106 @@ func (svc *Service) imgHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (svc *Service) placeholderHandler(rw http.ResponseWriter, req *http.Request) {
+	placeholderType := PlaceholderBlurhash
+	if t := req.URL.Query().Get("type"); t != "" {
+		var err error
+		if placeholderType, err = ParsePlaceholderType(t); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	placeholder, err := svc.store.Placeholder(mux.Vars(req)["filename"], placeholderType)
+	if err == ErrOriginalNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("not found"))
+		return
+	}
+	if err != nil {
+		log.Printf("failed to compute a placeholder: %s\n", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(placeholder); err != nil {
+		log.Printf("failed to serve a placeholder: %s\n", err)
+	}
+}
+
+func (svc *Service) colorsHandler(rw http.ResponseWriter, req *http.Request) {
+	job, err := NewPaletteJob(mux.Vars(req)["filename"], req.URL.Query())
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	palette, ok, err := svc.store.Palette(job)
+	if err == ErrOriginalNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("not found"))
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read a palette: %s\n", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		// Palettes are computed by the workers, like derivatives
+		if err := svc.queue.EnqueuePalette(job); err != nil {
+			log.Printf("failed to enqueue a palette job: %s\n", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(svc.httpTimeout)*time.Millisecond)
+		defer cancel()
+
+		err := svc.ackbus.Receive(ctx, job.Key())
+		if _, ok := err.(processingError); ok {
+			rw.WriteHeader(http.StatusUnprocessableEntity)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			log.Printf("failed to receive a palette: %s\n", err)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if palette, ok, err = svc.store.Palette(job); err != nil || !ok {
+			log.Printf("failed to read a computed palette: %v\n", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(palette); err != nil {
+		log.Printf("failed to serve a palette: %s\n", err)
+	}
+}
+
+func (svc *Service) infoHandler(rw http.ResponseWriter, req *http.Request) {
+	info, err := svc.store.Info(mux.Vars(req)["filename"])
+	if err == ErrOriginalNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("not found"))
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read the info of an original: %s\n", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(info); err != nil {
+		log.Printf("failed to serve the info of an original: %s\n", err)
+	}
+}
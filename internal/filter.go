@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+)
+
+// Filters are applied to derivatives after scaling, in the order of the fields below,
+// which is also the order they appear in in derivative names
+type Filters struct {
+	Grayscale  bool    `json:"grayscale,omitempty"`
+	Sepia      bool    `json:"sepia,omitempty"`
+	Brightness int     `json:"brightness,omitempty"` // -100 to 100, in percents
+	Contrast   int     `json:"contrast,omitempty"`   // -100 to 100, in percents
+	Blur       float64 `json:"blur,omitempty"`       // standard deviation of the gaussian, in pixels
+	Sharpen    float64 `json:"sharpen,omitempty"`    // amount of the unsharp mask
+}
+
+// IsZero tells whether no filter is applied
+func (f Filters) IsZero() bool {
+	return f == Filters{}
+}
+
+// nameParts lists the filters in the order they're applied
+func (f Filters) nameParts() []string {
+	var parts []string
+	if f.Grayscale {
+		parts = append(parts, "grayscale")
+	}
+	if f.Sepia {
+		parts = append(parts, "sepia")
+	}
+	if f.Brightness != 0 {
+		parts = append(parts, fmt.Sprintf("brightness%d", f.Brightness))
+	}
+	if f.Contrast != 0 {
+		parts = append(parts, fmt.Sprintf("contrast%d", f.Contrast))
+	}
+	if f.Blur != 0 {
+		parts = append(parts, "blur"+strconv.FormatFloat(f.Blur, 'f', -1, 64))
+	}
+	if f.Sharpen != 0 {
+		parts = append(parts, "sharpen"+strconv.FormatFloat(f.Sharpen, 'f', -1, 64))
+	}
+	return parts
+}
+
+// apply runs the filters on img, in place when it can
+func (f Filters) apply(img *image.RGBA) *image.RGBA {
+	if f.Grayscale || f.Sepia || f.Brightness != 0 || f.Contrast != 0 {
+		f.applyColors(img)
+	}
+	if f.Blur != 0 {
+		img = gaussianBlur(img, f.Blur)
+	}
+	if f.Sharpen != 0 {
+		img = unsharpMask(img, f.Sharpen)
+	}
+	return img
+}
+
+// applyColors runs the per pixel filters, on non premultiplied colors
+func (f Filters) applyColors(img *image.RGBA) {
+	brightness := float64(f.Brightness) * 255 / 100
+	contrast := float64(100+f.Contrast) / 100
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			a := float64(p[3])
+			if a == 0 {
+				continue
+			}
+			r, g, bl := float64(p[0])*255/a, float64(p[1])*255/a, float64(p[2])*255/a
+
+			if f.Grayscale {
+				r = 0.299*r + 0.587*g + 0.114*bl
+				g, bl = r, r
+			}
+			if f.Sepia {
+				r, g, bl = 0.393*r+0.769*g+0.189*bl, 0.349*r+0.686*g+0.168*bl, 0.272*r+0.534*g+0.131*bl
+			}
+			r, g, bl = r+brightness, g+brightness, bl+brightness
+			r, g, bl = (r-128)*contrast+128, (g-128)*contrast+128, (bl-128)*contrast+128
+
+			p[0] = premultiply(r, a)
+			p[1] = premultiply(g, a)
+			p[2] = premultiply(bl, a)
+		}
+	}
+}
+
+func premultiply(c, a float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(255, c)) * a / 255))
+}
+
+// gaussianBlur blurs img with a separable gaussian kernel; premultiplied colors keep transparent pixels
+// from bleeding into their neighbours
+func gaussianBlur(img *image.RGBA, sigma float64) *image.RGBA {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tmp := image.NewRGBA(image.Rect(0, 0, w, h))
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	convolve := func(dst, src *image.RGBA, min image.Point, dx, dy int) {
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var acc [4]float64
+				for i, k := range kernel {
+					sx := clampInt(x+(i-radius)*dx, 0, w-1)
+					sy := clampInt(y+(i-radius)*dy, 0, h-1)
+					p := src.Pix[src.PixOffset(min.X+sx, min.Y+sy):]
+					for c := 0; c < 4; c++ {
+						acc[c] += k * float64(p[c])
+					}
+				}
+				d := dst.Pix[dst.PixOffset(x, y):]
+				for c := 0; c < 4; c++ {
+					d[c] = uint8(clampInt(int(math.Round(acc[c])), 0, 255))
+				}
+			}
+		}
+	}
+	convolve(tmp, img, b.Min, 1, 0)
+	convolve(dst, tmp, image.Point{}, 0, 1)
+	return dst
+}
+
+// unsharpMask sharpens img by adding back amount times its difference with a blurred copy
+func unsharpMask(img *image.RGBA, amount float64) *image.RGBA {
+	blurred := gaussianBlur(img, 1)
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			s := img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y):]
+			bl := blurred.Pix[blurred.PixOffset(x, y):]
+			d := dst.Pix[dst.PixOffset(x, y):]
+			d[3] = s[3]
+			for c := 0; c < 3; c++ {
+				v := float64(s[c]) + amount*(float64(s[c])-float64(bl[c]))
+				// Premultiplied colors can't exceed their alpha
+				d[c] = uint8(clampInt(int(math.Round(v)), 0, int(s[3])))
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func Test_Filters_apply(t *testing.T) {
+	// A checkerboard, the harshest case for blurring and sharpening
+	checkerboard := func() *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 16; x++ {
+				c := color.RGBA{R: 64, G: 128, B: 32, A: 255}
+				if (x+y)%2 == 0 {
+					c = color.RGBA{R: 192, G: 160, B: 224, A: 255}
+				}
+				img.SetRGBA(x, y, c)
+			}
+		}
+		return img
+	}
+	spread := func(img *image.RGBA) int {
+		min, max := 255, 0
+		for i := 0; i < len(img.Pix); i += 4 {
+			min, max = minInt(min, int(img.Pix[i])), maxInt(max, int(img.Pix[i]))
+		}
+		return max - min
+	}
+
+	gray := Filters{Grayscale: true}.apply(checkerboard())
+	for i := 0; i < len(gray.Pix); i += 4 {
+		if p := gray.Pix[i : i+3]; p[0] != p[1] || p[1] != p[2] {
+			t.Fatalf("expected a gray pixel, got color: %v", p)
+		}
+	}
+
+	if e, a := 0, spread(Filters{Brightness: 100}.apply(checkerboard())); e != a {
+		t.Errorf("expected full brightness to wash out the image, got spread: %v", a)
+	}
+	if e, a := 0, spread(Filters{Contrast: -100}.apply(checkerboard())); e != a {
+		t.Errorf("expected no contrast to flatten the image, got spread: %v", a)
+	}
+	if a := spread(Filters{Blur: 2}.apply(checkerboard())); a >= 128 {
+		t.Errorf("expected blurring to narrow the spread of 128, got spread: %v", a)
+	}
+	if a := spread(Filters{Sharpen: 1}.apply(checkerboard())); a <= 128 {
+		t.Errorf("expected sharpening to widen the spread of 128, got spread: %v", a)
+	}
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	// WebP originals are read by x/image, derivatives are written by encodeWebP
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	ErrInvalidFormat     = errors.New("format must be one of jpeg, png, webp, gif")
+	ErrUnsupportedFormat = errors.New("output format not supported by the resizer backend")
+)
+
+// Format is the encoding of an image
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatWebP Format = "webp"
+	FormatGIF  Format = "gif"
+)
+
+// formatExtensions holds the file extension derivatives of each format are stored under
+var formatExtensions = map[Format]string{
+	FormatJPEG: ".jpg",
+	FormatPNG:  ".png",
+	FormatWebP: ".webp",
+	FormatGIF:  ".gif",
+}
+
+// encodableFormats are the formats derivatives can be written in
+var encodableFormats = map[Format]bool{
+	FormatJPEG: true,
+	FormatPNG:  true,
+	FormatWebP: true,
+	FormatGIF:  true,
+}
+
+var formatMIMETypes = map[Format]string{
+	FormatJPEG: "image/jpeg",
+	FormatPNG:  "image/png",
+	FormatWebP: "image/webp",
+	FormatGIF:  "image/gif",
+}
+
+func ParseFormat(s string) (Format, error) {
+	switch format := Format(strings.ToLower(s)); format {
+	case FormatJPEG, FormatPNG, FormatWebP, FormatGIF:
+		return format, nil
+	case "jpg":
+		return FormatJPEG, nil
+	}
+	return "", ErrInvalidFormat
+}
+
+// FormatFromFilename guesses the format of a file from its extension; unknown extensions give an empty Format
+func FormatFromFilename(filename string) Format {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg":
+		return FormatJPEG
+	case ".png":
+		return FormatPNG
+	case ".webp":
+		return FormatWebP
+	case ".gif":
+		return FormatGIF
+	}
+	return ""
+}
+
+func (f Format) Extension() string {
+	return formatExtensions[f]
+}
+
+// HasAlpha tells whether the format can encode transparency
+func (f Format) HasAlpha() bool {
+	return f != FormatJPEG
+}
+
+// Lossy tells whether the format trades quality for size; WebP derivatives are lossless
+func (f Format) Lossy() bool {
+	return f == FormatJPEG
+}
+
+// Encodable tells whether derivatives can be produced in the format
+func (f Format) Encodable() bool {
+	return encodableFormats[f]
+}
+
+// MIMEType of the format; unknown formats are typed after the extension of filename
+func (f Format) MIMEType(filename string) string {
+	if t, ok := formatMIMETypes[f]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(filepath.Ext(filename)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// decodeError is the failure to decode an original, which retrying can't fix
+type decodeError struct {
+	err error
+}
+
+func (e decodeError) Error() string {
+	return fmt.Sprintf("failed to decode image: %s", e.err)
+}
+
+// encode writes dst in the format and with the encoder options of img
+func encode(w io.Writer, dst image.Image, img Imgmeta) error {
+	quality := img.Quality
+	if quality == 0 {
+		quality = 100
+	}
+
+	switch img.OutputFormat() {
+	case FormatJPEG:
+		if img.Progressive {
+			return encodeProgressiveJPEG(w, dst, quality)
+		}
+		return jpeg.Encode(w, dst, &jpeg.Options{Quality: quality})
+	case FormatPNG:
+		return png.Encode(w, dst)
+	case FormatWebP:
+		return encodeWebP(w, dst)
+	case FormatGIF:
+		return gif.Encode(w, dst, nil)
+	}
+	return ErrUnsupportedFormat
+}
+
+// NegotiateFormat picks, in order of preference, the first of the offered formats an Accept header
+// explicitly asks for; wildcards don't count, as they don't tell anything about the newer formats.
+// It returns an empty Format when none is acceptable.
+func NegotiateFormat(accept string, offers []Format) Format {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(q, 64); err != nil || v <= 0 {
+				continue
+			}
+		}
+		accepted[mediaType] = true
+	}
+
+	for _, format := range offers {
+		if accepted[formatMIMETypes[format]] {
+			return format
+		}
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"testing"
+)
+
+func Test_Format_MIMEType(t *testing.T) {
+	tests := []struct {
+		name     string
+		mimeType string
+	}{
+		{"landscape.jpg", "image/jpeg"},
+		{"landscape_300x200.jpg.png", "image/png"},
+		{"landscape.jpg.webp", "image/webp"},
+		{"animation.GIF", "image/gif"},
+		{"notes.txt", "text/plain; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		if a := FormatFromFilename(tt.name).MIMEType(tt.name); a != tt.mimeType {
+			t.Errorf("%s: expected mime type: %v, got mime type: %v", tt.name, tt.mimeType, a)
+		}
+	}
+}
+
+func Test_NegotiateFormat(t *testing.T) {
+	offers := []Format{FormatWebP, FormatPNG}
+	tests := []struct {
+		accept string
+		format Format
+	}{
+		{"", ""},
+		{"*/*", ""},
+		{"image/*,*/*;q=0.8", ""},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", FormatWebP},
+		{"image/png, image/webp", FormatWebP},
+		{"image/webp;q=0, image/png", FormatPNG},
+		{"image/jpeg", ""},
+	}
+
+	for _, tt := range tests {
+		if a := NegotiateFormat(tt.accept, offers); a != tt.format {
+			t.Errorf("%q: expected format: %v, got format: %v", tt.accept, tt.format, a)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"math"
+)
+
+var (
+	ErrInvalidICC         = errors.New("icc must be srgb or keep")
+	errUnsupportedProfile = errors.New("unsupported ICC profile")
+)
+
+// srgbD50 is the matrix of the sRGB primaries, adapted to the D50 white point of the ICC connection space
+var srgbD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// iccTransform converts the pixels of an RGB matrix/TRC profile, the kind Adobe RGB and Display P3 are, to sRGB
+type iccTransform struct {
+	linear [3][256]float64 // tone response curves of the profile, per channel
+	matrix [3][3]float64   // from the linear profile space to linear sRGB
+}
+
+// srgbEncoding maps linear light, quantized to 12 bits, to sRGB values
+var srgbEncoding = func() (lut [4096]uint8) {
+	for i := range lut {
+		v := float64(i) / float64(len(lut)-1)
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		lut[i] = uint8(math.Round(v * 255))
+	}
+	return lut
+}()
+
+// newICCTransform parses an ICC profile; only RGB profiles with colorant and tone response curve tags
+// are supported, LUT based ones are not
+func newICCTransform(profile []byte) (*iccTransform, error) {
+	if len(profile) < 132 || string(profile[16:20]) != "RGB " {
+		return nil, errUnsupportedProfile
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			return nil, errUnsupportedProfile
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, errUnsupportedProfile
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+
+	var t iccTransform
+	var colorants [3][3]float64
+	for c, name := range []string{"r", "g", "b"} {
+		xyz, ok := tags[name+"XYZ"]
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, errUnsupportedProfile
+		}
+		for i := 0; i < 3; i++ {
+			colorants[i][c] = s15Fixed16(xyz[8+4*i:])
+		}
+
+		curve, err := parseICCCurve(tags[name+"TRC"])
+		if err != nil {
+			return nil, err
+		}
+		for v := range t.linear[c] {
+			t.linear[c][v] = curve(float64(v) / 255)
+		}
+	}
+
+	inverse, ok := invert3(srgbD50)
+	if !ok {
+		return nil, errUnsupportedProfile
+	}
+	t.matrix = multiply3(inverse, colorants)
+	return &t, nil
+}
+
+// parseICCCurve reads a curv or para tag into the function mapping encoded values to linear light
+func parseICCCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, errUnsupportedProfile
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n < 0 || len(tag) < 12+2*n {
+			return nil, errUnsupportedProfile
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			pos := x * float64(n-1)
+			i := minInt(int(pos), n-2)
+			return table[i] + (pos-float64(i))*(table[i+1]-table[i])
+		}, nil
+
+	case "para":
+		paramCounts := []int{1, 3, 4, 5, 7}
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		if kind >= len(paramCounts) || len(tag) < 12+4*paramCounts[kind] {
+			return nil, errUnsupportedProfile
+		}
+		// g, a, b, c, d, e, f as in the ICC specification, with the defaults that make the unused ones vanish
+		p := [7]float64{1, 1, 0, 0, 0, 0, 0}
+		for i := 0; i < paramCounts[kind]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		switch kind {
+		case 1:
+			d = -b / a
+		case 2:
+			d, e, f = -b/a, c, c
+			c = 0
+		}
+		return func(x float64) float64 {
+			if x >= d {
+				return math.Pow(math.Max(0, a*x+b), g) + e
+			}
+			return c*x + f
+		}, nil
+	}
+	return nil, errUnsupportedProfile
+}
+
+// isSRGB tells whether the transform leaves pixels as they are, up to the rounding of profiles,
+// as it does for the sRGB profiles cameras and editors embed
+func (t *iccTransform) isSRGB() bool {
+	for c := 0; c < 3; c++ {
+		for i := 0; i < 3; i++ {
+			identity := 0.0
+			if i == c {
+				identity = 1
+			}
+			if math.Abs(t.matrix[c][i]-identity) > 0.002 {
+				return false
+			}
+		}
+		for v := range t.linear[c] {
+			if math.Abs(t.linear[c][v]-srgbToLinear(uint8(v))) > 0.002 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isSRGBProfile tells whether an embedded profile is sRGB, which is the same as having none
+func isSRGBProfile(profile []byte) bool {
+	t, err := newICCTransform(profile)
+	return err == nil && t.isSRGB()
+}
+
+// apply converts img to sRGB in place
+func (t *iccTransform) apply(img *image.RGBA) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			a := p[3]
+			if a == 0 {
+				continue
+			}
+			var in [3]float64
+			for c := range in {
+				in[c] = t.linear[c][uint8(math.Round(float64(p[c])*255/float64(a)))]
+			}
+			for c := 0; c < 3; c++ {
+				v := t.matrix[c][0]*in[0] + t.matrix[c][1]*in[1] + t.matrix[c][2]*in[2]
+				out := srgbEncoding[int(math.Round(math.Max(0, math.Min(1, v))*float64(len(srgbEncoding)-1)))]
+				p[c] = uint8(math.Round(float64(out) * float64(a) / 255))
+			}
+		}
+	}
+}
+
+// toSRGB converts img to sRGB from the given profile when it can, telling whether it did
+func toSRGB(img *image.RGBA, profile []byte) bool {
+	if profile == nil {
+		return false
+	}
+	t, err := newICCTransform(profile)
+	if err != nil {
+		return false
+	}
+	// The pixels of sRGB profiles are sRGB already
+	if !t.isSRGB() {
+		t.apply(img)
+	}
+	return true
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func multiply3(a, b [3][3]float64) (m [3][3]float64) {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+func invert3(m [3][3]float64) (inv [3][3]float64, ok bool) {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	if det == 0 {
+		return inv, false
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// Cofactor of the transposed matrix
+			r0, r1 := (j+1)%3, (j+2)%3
+			c0, c1 := (i+1)%3, (i+2)%3
+			inv[i][j] = (m[r0][c0]*m[r1][c1] - m[r0][c1]*m[r1][c0]) / det
+		}
+	}
+	return inv, true
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// testICCProfile builds an RGB profile of the given colorants, in columns, with the sRGB tone response curve
+func testICCProfile(colorants [3][3]float64) []byte {
+	fixed := func(v float64) []byte {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(int32(math.Round(v*65536))))
+		return b[:]
+	}
+	var data bytes.Buffer
+	for c := 0; c < 3; c++ {
+		data.WriteString("XYZ \x00\x00\x00\x00")
+		for i := 0; i < 3; i++ {
+			data.Write(fixed(colorants[i][c]))
+		}
+	}
+	trc := data.Len()
+	data.WriteString("para\x00\x00\x00\x00\x00\x03\x00\x00")
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		data.Write(fixed(v))
+	}
+
+	header := make([]byte, 128)
+	copy(header[16:], "RGB ")
+	var table bytes.Buffer
+	binary.Write(&table, binary.BigEndian, uint32(6))
+	start := uint32(128 + 4 + 6*12)
+	for i, tag := range []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"} {
+		offset, size := start+uint32(i*20), uint32(20)
+		if i >= 3 {
+			offset, size = start+uint32(trc), uint32(data.Len()-trc)
+		}
+		table.WriteString(tag)
+		binary.Write(&table, binary.BigEndian, []uint32{offset, size})
+	}
+	return append(append(header, table.Bytes()...), data.Bytes()...)
+}
+
+func Test_iccTransform(t *testing.T) {
+	srgb := testICCProfile(srgbD50)
+	p3 := testICCProfile([3][3]float64{
+		{0.515121, 0.291977, 0.157104},
+		{0.241196, 0.692245, 0.066574},
+		{-0.001053, 0.041885, 0.784073},
+	})
+
+	tests := []struct {
+		profile  []byte
+		in       color.NRGBA
+		expected color.NRGBA
+	}{
+		{srgb, color.NRGBA{200, 100, 50, 255}, color.NRGBA{200, 100, 50, 255}},
+		{p3, color.NRGBA{128, 128, 128, 255}, color.NRGBA{128, 128, 128, 255}},
+		{p3, color.NRGBA{255, 0, 0, 255}, color.NRGBA{255, 0, 0, 255}},
+		{p3, color.NRGBA{200, 100, 50, 255}, color.NRGBA{215, 93, 31, 255}},
+		{p3, color.NRGBA{200, 100, 50, 128}, color.NRGBA{215, 93, 31, 128}},
+	}
+
+	for _, tt := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		img.Set(0, 0, tt.in)
+		if !toSRGB(img, tt.profile) {
+			t.Fatalf("failed to convert to sRGB")
+		}
+		actual := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA)
+		for c, d := range []int{int(actual.R) - int(tt.expected.R), int(actual.G) - int(tt.expected.G),
+			int(actual.B) - int(tt.expected.B), int(actual.A) - int(tt.expected.A)} {
+			if d > 2 || d < -2 {
+				t.Errorf("%v: expected color: %v, got color: %v (channel %d)", tt.in, tt.expected, actual, c)
+			}
+		}
+	}
+
+	if toSRGB(image.NewRGBA(image.Rect(0, 0, 1, 1)), []byte("not a profile")) {
+		t.Errorf("expected invalid profiles to be left alone")
+	}
+
+	// sRGB profiles are as good as none
+	for _, tt := range []struct {
+		profile  []byte
+		expected bool
+	}{{srgb, true}, {p3, false}, {[]byte("not a profile"), false}} {
+		if actual := isSRGBProfile(tt.profile); actual != tt.expected {
+			t.Errorf("expected sRGB: %v, got sRGB: %v", tt.expected, actual)
+		}
+	}
+}
@@ -1,28 +1,263 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
-	"errors"
+	"unicode/utf8"
 )
 
+// derivativePartRegexp matches any of the parts Name appends to the name of the original
+var derivativePartRegexp = regexp.MustCompile("^([0-9]+x[0-9]+|dpr[0-9.]+|contain|cover|fill|outside|g-.+|fp-.+|" +
+	"frame[0-9]+|r[0-9]+|flip-.+|noorient|crop-.+|pad[0-9]+|bg-.+|radius[0-9]+|mask-.+|grayscale|sepia|" +
+	"brightness-?[0-9]+|contrast-?[0-9]+|blur[0-9.]+|sharpen[0-9.]+|wm-.+|text-.+|q[0-9]+|progressive|strip|" +
+	"icc-keep|maxbytes[0-9]+)$")
+
 var (
-	resRegexp            = regexp.MustCompile("[0-9]+x[0-9]+$")
-	ErrInvalidResolution = errors.New("invalid resolution")
+	resRegexp            = regexp.MustCompile("^([0-9]*)x([0-9]*)$")
+	ErrInvalidResolution = errors.New("size must be formatted as 123x123, 123x or x123")
+	ErrSizeAndDimensions = errors.New("size can't be used together with w and h")
+	ErrInvalidFit        = errors.New("fit must be one of contain, cover, fill, inside, outside")
+	ErrInvalidGravity    = errors.New("gravity must be one of center, north, north-east, east, south-east, south, south-west, west, north-west, smart")
+	ErrInvalidFocalPoint = errors.New("fp must be formatted as x,y with both coordinates between 0 and 1")
+	ErrGravityFocalPoint = errors.New("gravity and fp can't be used together")
+	ErrInvalidQuality    = errors.New("q must be an integer between 1 and 100")
+	ErrInvalidFlag       = errors.New("progressive and strip must be true or false")
+	ErrInvalidMaxBytes   = errors.New("maxbytes must be a positive integer")
+	ErrLosslessMaxBytes  = errors.New("maxbytes only applies to lossy formats, such as jpeg")
+	ErrInvalidDPR        = errors.New("dpr must be a number between 1 and 4")
+	ErrDPRWithoutSize    = errors.New("dpr can only be used together with size, w or h")
+	ErrInvalidRotate     = errors.New("rotate must be one of 90, 180, 270")
+	ErrInvalidFlip       = errors.New("flip must be one of h, v")
+	ErrInvalidOrient     = errors.New("orient must be true or false")
+	ErrInvalidCrop       = errors.New("crop must be formatted as x,y,w,h in pixels (10,20,300,200) or percentages (10%,20%,50%,50%)")
+	ErrCropOutOfBounds   = errors.New("crop exceeds the dimensions of the original")
+	ErrInvalidColorFlag  = errors.New("grayscale and sepia must be true or false")
+	ErrInvalidBrightness = errors.New("brightness and contrast must be integers between -100 and 100")
+	ErrInvalidBlur       = errors.New("blur must be a number between 0 and 10")
+	ErrInvalidSharpen    = errors.New("sharpen must be a number between 0 and 10")
+	ErrInvalidPad        = errors.New("pad must be an integer between 0 and 1000, leaving room for the image")
+)
+
+// maxDimension bounds what is parsed from requests, so that no computation on dimensions can overflow;
+// the actual limits are set by the SizePolicy of the service
+const maxDimension = 1 << 16
+
+// Fit tells how an image is mapped onto the requested width x height box
+type Fit string
+
+const (
+	FitContain Fit = "contain" // fit inside the box, letterboxed to its exact size
+	FitCover   Fit = "cover"   // fill the whole box, cropping what overflows
+	FitFill    Fit = "fill"    // stretch to the exact box, ignoring the aspect ratio
+	FitInside  Fit = "inside"  // fit inside the box, output may be smaller than the box
+	FitOutside Fit = "outside" // cover the box, output may be larger than the box
+)
+
+// DefaultFit is what the service always did before fit modes existed
+const DefaultFit = FitInside
+
+func ParseFit(s string) (Fit, error) {
+	switch fit := Fit(s); fit {
+	case FitContain, FitCover, FitFill, FitInside, FitOutside:
+		return fit, nil
+	case "":
+		return DefaultFit, nil
+	}
+	return "", ErrInvalidFit
+}
+
+// Gravity tells which part of an image survives when it has to be cropped
+type Gravity string
+
+const (
+	GravityCenter    Gravity = "center"
+	GravityNorth     Gravity = "north"
+	GravityNorthEast Gravity = "north-east"
+	GravityEast      Gravity = "east"
+	GravitySouthEast Gravity = "south-east"
+	GravitySouth     Gravity = "south"
+	GravitySouthWest Gravity = "south-west"
+	GravityWest      Gravity = "west"
+	GravityNorthWest Gravity = "north-west"
+	GravitySmart     Gravity = "smart" // the most detailed region, found by scoring the image content
 )
 
+// gravityAnchors holds, for each gravity, the relative position of the kept region within the image
+var gravityAnchors = map[Gravity][2]float64{
+	GravityCenter:    {0.5, 0.5},
+	GravityNorth:     {0.5, 0},
+	GravityNorthEast: {1, 0},
+	GravityEast:      {1, 0.5},
+	GravitySouthEast: {1, 1},
+	GravitySouth:     {0.5, 1},
+	GravitySouthWest: {0, 1},
+	GravityWest:      {0, 0.5},
+	GravityNorthWest: {0, 0},
+}
+
+func ParseGravity(s string) (Gravity, error) {
+	switch Gravity(s) {
+	case "":
+		return GravityCenter, nil
+	case GravitySmart:
+		return GravitySmart, nil
+	}
+	if _, ok := gravityAnchors[Gravity(s)]; !ok {
+		return "", ErrInvalidGravity
+	}
+	return Gravity(s), nil
+}
+
+// FocalPoint is the point of interest of an image, in coordinates relative to its size
+type FocalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// ParseFocalPoint parses a "x,y" focal point; coordinates are rounded to 3 decimals
+// so that nearly identical focal points share their derivatives.
+func ParseFocalPoint(s string) (*FocalPoint, error) {
+	coords := strings.Split(s, ",")
+	if len(coords) != 2 {
+		return nil, ErrInvalidFocalPoint
+	}
+
+	var fp [2]float64
+	for i, c := range coords {
+		v, err := strconv.ParseFloat(strings.TrimSpace(c), 64)
+		if err != nil || v < 0 || v > 1 {
+			return nil, ErrInvalidFocalPoint
+		}
+		fp[i] = math.Round(v*1000) / 1000
+	}
+	return &FocalPoint{X: fp[0], Y: fp[1]}, nil
+}
+
+// Flip mirrors an image along one of its axes
+type Flip string
+
+const (
+	FlipHorizontal Flip = "h" // left becomes right
+	FlipVertical   Flip = "v" // top becomes bottom
+)
+
+func ParseFlip(s string) (Flip, error) {
+	switch flip := Flip(s); flip {
+	case FlipHorizontal, FlipVertical:
+		return flip, nil
+	}
+	return "", ErrInvalidFlip
+}
+
+// Crop is a region of the original, in pixels or in percentages of its dimensions
+type Crop struct {
+	X, Y, W, H float64
+	Percent    bool
+}
+
+func ParseCrop(s string) (*Crop, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, ErrInvalidCrop
+	}
+
+	var crop Crop
+	crop.Percent = strings.HasSuffix(parts[0], "%")
+	values := []*float64{&crop.X, &crop.Y, &crop.W, &crop.H}
+	for i, part := range parts {
+		if strings.HasSuffix(part, "%") != crop.Percent {
+			return nil, ErrInvalidCrop
+		}
+		part = strings.TrimSuffix(part, "%")
+		if crop.Percent {
+			v, err := strconv.ParseFloat(part, 64)
+			if err != nil || v < 0 || v > 100 {
+				return nil, ErrInvalidCrop
+			}
+			*values[i] = math.Round(v*100) / 100
+		} else {
+			v, err := strconv.Atoi(part)
+			if err != nil || v < 0 || v > maxDimension {
+				return nil, ErrInvalidCrop
+			}
+			*values[i] = float64(v)
+		}
+	}
+	if crop.W == 0 || crop.H == 0 || crop.Percent && (crop.X+crop.W > 100 || crop.Y+crop.H > 100) {
+		return nil, ErrInvalidCrop
+	}
+	return &crop, nil
+}
+
+// Rect maps the crop onto a width x height original
+func (c Crop) Rect(width, height int) (image.Rectangle, error) {
+	r := image.Rect(int(c.X), int(c.Y), int(c.X+c.W), int(c.Y+c.H))
+	if c.Percent {
+		r = image.Rect(int(math.Round(c.X*float64(width)/100)), int(math.Round(c.Y*float64(height)/100)),
+			int(math.Round((c.X+c.W)*float64(width)/100)), int(math.Round((c.Y+c.H)*float64(height)/100)))
+	}
+	if r.Empty() || !r.In(image.Rect(0, 0, width, height)) {
+		return image.Rectangle{}, ErrCropOutOfBounds
+	}
+	return r, nil
+}
+
+func (c Crop) String() string {
+	unit := ""
+	if c.Percent {
+		unit = "p"
+	}
+	var parts []string
+	for _, v := range []float64{c.X, c.Y, c.W, c.H} {
+		parts = append(parts, strconv.FormatFloat(v, 'f', -1, 64)+unit)
+	}
+	return strings.Join(parts, "-")
+}
+
+// DefaultBackground is what transparency is flattened onto when there is no bg
+var DefaultBackground = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+
 type Imgmeta struct {
-	Original   string `json:"original"`
-	IsOriginal bool   `json:"is_original"`
-	Width      int    `json:"width"`
-	Height     int    `json:"height"`
+	Original    string       `json:"original"`
+	IsOriginal  bool         `json:"is_original"`
+	Width       int          `json:"width"`
+	Height      int          `json:"height"`
+	DPR         float64      `json:"dpr,omitempty"` // device pixel ratio Width and Height were multiplied by
+	Fit         Fit          `json:"fit,omitempty"`
+	Gravity     Gravity      `json:"gravity,omitempty"`
+	FocalPoint  *FocalPoint  `json:"focal_point,omitempty"`
+	Frame       *int         `json:"frame,omitempty"`      // still extracted from an animated original
+	Rotate      int          `json:"rotate,omitempty"`     // clockwise, in degrees
+	Flip        Flip         `json:"flip,omitempty"`       // applied after Rotate
+	NoOrient    bool         `json:"no_orient,omitempty"`  // ignore the EXIF orientation of the original
+	Crop        *Crop        `json:"crop,omitempty"`       // region of the oriented original that is kept
+	Pad         int          `json:"pad,omitempty"`        // border around the image, in pixels
+	Background  *color.NRGBA `json:"background,omitempty"` // letterboxing and padding color
+	Radius      int          `json:"radius,omitempty"`     // of the rounded corners, in pixels
+	Mask        Mask         `json:"mask,omitempty"`       // shape the image is cut to
+	Filters     Filters      `json:"filters"`              // applied after scaling
+	Watermark   *Watermark   `json:"watermark,omitempty"`
+	Text        *TextOverlay `json:"text,omitempty"`
+	Format      Format       `json:"format,omitempty"`  // empty when the original format is kept
+	Quality     int          `json:"quality,omitempty"` // encoder quality of lossy formats
+	Progressive bool         `json:"progressive,omitempty"`
+	Strip       bool         `json:"strip,omitempty"`     // drop the EXIF and ICC metadata of the original
+	KeepICC     bool         `json:"keep_icc,omitempty"`  // keep the color profile of the original rather than converting to sRGB
+	MaxBytes    int          `json:"max_bytes,omitempty"` // byte budget, met by lowering the quality
 }
 
 // Name generates an image name; for Original images, name remains the same;
-// for new images, name is formatted as {originalFilename_1200x700.extension}
+// for new images, name is formatted as {originalFilename_1200x700.extension},
+// with the non default options appended in a fixed order: {originalFilename_1200x700_cover_g-north.extension};
+// converted images get the extension of their format appended: {originalFilename_1200x700.png.jpg}
 func (img Imgmeta) Name() string {
 	if img.IsOriginal {
 		return img.Original
@@ -30,32 +265,553 @@ func (img Imgmeta) Name() string {
 
 	ext := filepath.Ext(img.Original)
 	filenameWithoutExt := strings.TrimSuffix(img.Original, ext)
-	return fmt.Sprintf("%s_%dx%d%s", filenameWithoutExt, img.Width, img.Height, ext)
+
+	parts := []string{filenameWithoutExt}
+	if img.Width != 0 || img.Height != 0 {
+		parts = append(parts, fmt.Sprintf("%dx%d", img.Width, img.Height))
+	}
+	if img.DPR != 0 && img.DPR != 1 {
+		parts = append(parts, "dpr"+strconv.FormatFloat(img.DPR, 'f', -1, 64))
+	}
+	if img.Fit != "" && img.Fit != DefaultFit {
+		parts = append(parts, string(img.Fit))
+	}
+	if img.Gravity != "" && img.Gravity != GravityCenter {
+		parts = append(parts, "g-"+string(img.Gravity))
+	}
+	if img.FocalPoint != nil {
+		parts = append(parts, "fp-"+strconv.FormatFloat(img.FocalPoint.X, 'f', -1, 64)+
+			"-"+strconv.FormatFloat(img.FocalPoint.Y, 'f', -1, 64))
+	}
+	if img.Frame != nil {
+		parts = append(parts, fmt.Sprintf("frame%d", *img.Frame))
+	}
+	if img.Rotate != 0 {
+		parts = append(parts, fmt.Sprintf("r%d", img.Rotate))
+	}
+	if img.Flip != "" {
+		parts = append(parts, "flip-"+string(img.Flip))
+	}
+	if img.NoOrient {
+		parts = append(parts, "noorient")
+	}
+	if img.Crop != nil {
+		parts = append(parts, "crop-"+img.Crop.String())
+	}
+	if img.Pad != 0 {
+		parts = append(parts, fmt.Sprintf("pad%d", img.Pad))
+	}
+	if img.Background != nil {
+		parts = append(parts, "bg-"+colorHex(*img.Background))
+	}
+	if img.Radius != 0 {
+		parts = append(parts, fmt.Sprintf("radius%d", img.Radius))
+	}
+	if img.Mask != "" {
+		parts = append(parts, "mask-"+string(img.Mask))
+	}
+	parts = append(parts, img.Filters.nameParts()...)
+	if img.Watermark != nil {
+		parts = append(parts, "wm-"+img.Watermark.String())
+	}
+	if img.Text != nil {
+		parts = append(parts, "text-"+img.Text.Hash())
+	}
+	if img.Quality != 0 {
+		parts = append(parts, fmt.Sprintf("q%d", img.Quality))
+	}
+	if img.Progressive {
+		parts = append(parts, "progressive")
+	}
+	if img.Strip {
+		parts = append(parts, "strip")
+	}
+	if img.KeepICC {
+		parts = append(parts, "icc-keep")
+	}
+	if img.MaxBytes != 0 {
+		parts = append(parts, fmt.Sprintf("maxbytes%d", img.MaxBytes))
+	}
+	if img.Format != "" {
+		ext += img.Format.Extension()
+	}
+	return strings.Join(parts, "_") + ext
+}
+
+// OutputFormat is the format the image is encoded in; derivatives keep the format of their original
+// unless told otherwise, and originals in an unknown format are converted to JPEG.
+func (img Imgmeta) OutputFormat() Format {
+	if img.Format != "" {
+		return img.Format
+	}
+	if format := FormatFromFilename(img.Original); format != "" {
+		return format
+	}
+	return FormatJPEG
 }
 
-func NewImageFromRequest(filename string, resolution string) (img Imgmeta, err error) {
+// IsDerivativeName tells whether name is the name of a derivative of original, converted or not;
+// other originals sharing its prefix, such as photo_2.jpg for photo.jpg, don't start with a part of Name
+func IsDerivativeName(name, original string) bool {
+	ext := filepath.Ext(original)
+	prefix := strings.TrimSuffix(original, ext) + "_"
+	if name == original || !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	rest := strings.TrimPrefix(name, prefix)
+	// Converted derivatives have the extension of their format appended
+	for _, parts := range []string{rest, strings.TrimSuffix(rest, filepath.Ext(rest))} {
+		if !strings.HasSuffix(parts, ext) {
+			continue
+		}
+		first := strings.SplitN(strings.TrimSuffix(parts, ext), "_", 2)[0]
+		if derivativePartRegexp.MatchString(first) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewImageFromRequest builds the meta of the image asked for by the query parameters
+// of a request; without any transformation, the original image is asked for.
+func NewImageFromRequest(filename string, query url.Values) (img Imgmeta, err error) {
 	img.Original = filename
 
-	if resolution == "" {
-		img.IsOriginal = true
-		return img, nil
+	if err = img.parseSize(query); err != nil {
+		return img, err
+	}
+	if err = img.parseFrame(query); err != nil {
+		return img, err
+	}
+	if err = img.parseOrientation(query); err != nil {
+		return img, err
+	}
+	if err = img.parseBackground(query); err != nil {
+		return img, err
+	}
+	if err = img.parseMask(query); err != nil {
+		return img, err
+	}
+	if err = img.parseFilters(query); err != nil {
+		return img, err
+	}
+	if err = img.parseWatermark(query); err != nil {
+		return img, err
+	}
+	if err = img.parseText(query); err != nil {
+		return img, err
+	}
+	if err = img.parseFormat(query); err != nil {
+		return img, err
+	}
+	if err = img.parseEncoding(query); err != nil {
+		return img, err
+	}
+
+	img.IsOriginal = img.Name() == img.Original
+	return img, nil
+}
+
+// HasPartialSize tells whether only one dimension was asked for; the other one must be
+// computed from the aspect ratio of the original, see WithOriginalSize
+func (img Imgmeta) HasPartialSize() bool {
+	return (img.Width == 0) != (img.Height == 0)
+}
+
+// WithOriginalSize returns a copy of img whose missing dimension is computed from the size of its original
+func (img Imgmeta) WithOriginalSize(width, height int) Imgmeta {
+	if width < 1 || height < 1 {
+		return img
+	}
+	if img.Width == 0 && img.Height != 0 {
+		img.Width = maxInt(1, int(math.Round(float64(img.Height)*float64(width)/float64(height))))
+	}
+	if img.Height == 0 && img.Width != 0 {
+		img.Height = maxInt(1, int(math.Round(float64(img.Width)*float64(height)/float64(width))))
+	}
+	return img
+}
+
+// WithFormat returns a copy of img encoded in the given format
+func (img Imgmeta) WithFormat(format Format) Imgmeta {
+	img.IsOriginal = false
+	img.Format = format
+	if img.Format == FormatFromFilename(img.Original) {
+		img.Format = ""
+	}
+	img.IsOriginal = img.Name() == img.Original
+	return img
+}
+
+// parseSize reads the size of the box to resize to and how to fit the image into it
+func (img *Imgmeta) parseSize(query url.Values) (err error) {
+	// How to fit the image is checked even when it doesn't apply, so that typos don't go unnoticed
+	fit, err := ParseFit(query.Get("fit"))
+	if err != nil {
+		return err
 	}
 
-	// Handle invalid size
-	if !resRegexp.MatchString(resolution) {
-		return img, ErrInvalidResolution
+	if query.Get("gravity") != "" && query.Get("fp") != "" {
+		return ErrGravityFocalPoint
 	}
-	size := strings.Split(resolution, "x")
 
-	img.Width, err = strconv.Atoi(size[0])
+	gravity, err := ParseGravity(query.Get("gravity"))
 	if err != nil {
-		return img, ErrInvalidResolution
+		return err
+	}
+
+	var fp *FocalPoint
+	if query.Get("fp") != "" {
+		fp, err = ParseFocalPoint(query.Get("fp"))
+		if err != nil {
+			return err
+		}
+	}
+
+	resolution := query.Get("size")
+	if query.Get("w") != "" || query.Get("h") != "" {
+		if resolution != "" {
+			return ErrSizeAndDimensions
+		}
+		resolution = query.Get("w") + "x" + query.Get("h")
+	}
+	if resolution == "" {
+		// There is nothing for a device pixel ratio to multiply
+		if query.Get("dpr") != "" {
+			return ErrDPRWithoutSize
+		}
+		return nil
+	}
+
+	// Handle invalid size; either dimension may be left out, but not both
+	match := resRegexp.FindStringSubmatch(resolution)
+	if match == nil || match[1] == "" && match[2] == "" {
+		return ErrInvalidResolution
+	}
+
+	if match[1] != "" {
+		img.Width, err = strconv.Atoi(match[1])
+		if err != nil || img.Width < 1 || img.Width > maxDimension {
+			return ErrInvalidResolution
+		}
+	}
+
+	if match[2] != "" {
+		img.Height, err = strconv.Atoi(match[2])
+		if err != nil || img.Height < 1 || img.Height > maxDimension {
+			return ErrInvalidResolution
+		}
+	}
+
+	// Retina clients ask for CSS pixels and a device pixel ratio, rounded to 2 decimals
+	if dpr := query.Get("dpr"); dpr != "" {
+		img.DPR, err = strconv.ParseFloat(dpr, 64)
+		if err != nil || img.DPR < 1 || img.DPR > 4 {
+			return ErrInvalidDPR
+		}
+		img.DPR = math.Round(img.DPR*100) / 100
+		img.Width = int(math.Round(float64(img.Width) * img.DPR))
+		img.Height = int(math.Round(float64(img.Height) * img.DPR))
+	}
+
+	// A single dimension always keeps the aspect ratio, there is nothing to fit
+	if img.Width == 0 || img.Height == 0 {
+		return nil
+	}
+
+	img.Fit = fit
+
+	// Gravity and focal point only matter when the image gets cropped
+	if img.Fit == FitCover {
+		img.Gravity, img.FocalPoint = gravity, fp
+	}
+
+	return nil
+}
+
+// parseOrientation reads the rotation and flip applied on top of the EXIF orientation, if not ignored,
+// and the region of the result that is kept
+func (img *Imgmeta) parseOrientation(query url.Values) (err error) {
+	if r := query.Get("rotate"); r != "" {
+		img.Rotate, err = strconv.Atoi(r)
+		if err != nil || img.Rotate%90 != 0 || img.Rotate < 0 || img.Rotate >= 360 {
+			return ErrInvalidRotate
+		}
+	}
+
+	if f := query.Get("flip"); f != "" {
+		if img.Flip, err = ParseFlip(f); err != nil {
+			return err
+		}
+	}
+
+	if o := query.Get("orient"); o != "" {
+		orient, err := strconv.ParseBool(o)
+		if err != nil {
+			return ErrInvalidOrient
+		}
+		img.NoOrient = !orient
+	}
+
+	if c := query.Get("crop"); c != "" {
+		if img.Crop, err = ParseCrop(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseFrame reads the frame of an animated original a still is made of
+func (img *Imgmeta) parseFrame(query url.Values) error {
+	if f := query.Get("frame"); f != "" {
+		frame, err := strconv.Atoi(f)
+		if err != nil || frame < 0 || frame > maxFrame {
+			return ErrInvalidFrame
+		}
+		img.Frame = &frame
+	}
+	return nil
+}
+
+// parseBackground reads the padding around the image and the color of its background
+func (img *Imgmeta) parseBackground(query url.Values) (err error) {
+	if p := query.Get("pad"); p != "" {
+		img.Pad, err = strconv.Atoi(p)
+		if err != nil || img.Pad < 0 || img.Pad > 1000 ||
+			img.Width != 0 && 2*img.Pad >= img.Width || img.Height != 0 && 2*img.Pad >= img.Height {
+			return ErrInvalidPad
+		}
+	}
+
+	if bg := query.Get("bg"); bg != "" {
+		c, err := ParseColor(bg)
+		if err != nil {
+			return err
+		}
+		img.Background = &c
+	}
+
+	return nil
+}
+
+// parseMask reads the radius of the rounded corners and the shape the image is cut to
+func (img *Imgmeta) parseMask(query url.Values) (err error) {
+	if r := query.Get("radius"); r != "" {
+		img.Radius, err = strconv.Atoi(r)
+		if err != nil || img.Radius < 0 || img.Radius > 1000 {
+			return ErrInvalidRadius
+		}
+	}
+
+	if m := query.Get("mask"); m != "" {
+		if img.Mask, err = ParseMask(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BackgroundOrDefault is the color transparency is flattened onto
+func (img Imgmeta) BackgroundOrDefault() color.NRGBA {
+	if img.Background != nil {
+		return *img.Background
+	}
+	return DefaultBackground
+}
+
+// parseFilters reads the filters applied after scaling
+func (img *Imgmeta) parseFilters(query url.Values) (err error) {
+	for _, flag := range []struct {
+		key   string
+		value *bool
+	}{{"grayscale", &img.Filters.Grayscale}, {"sepia", &img.Filters.Sepia}} {
+		if v := query.Get(flag.key); v != "" {
+			*flag.value, err = strconv.ParseBool(v)
+			if err != nil {
+				return ErrInvalidColorFlag
+			}
+		}
+	}
+
+	for _, level := range []struct {
+		key   string
+		value *int
+	}{{"brightness", &img.Filters.Brightness}, {"contrast", &img.Filters.Contrast}} {
+		if v := query.Get(level.key); v != "" {
+			*level.value, err = strconv.Atoi(v)
+			if err != nil || *level.value < -100 || *level.value > 100 {
+				return ErrInvalidBrightness
+			}
+		}
+	}
+
+	// Blur kernels are 6 sigmas wide, so the bound keeps them to 61 taps
+	if b := query.Get("blur"); b != "" {
+		img.Filters.Blur, err = strconv.ParseFloat(b, 64)
+		if err != nil || img.Filters.Blur < 0 || img.Filters.Blur > 10 {
+			return ErrInvalidBlur
+		}
+		img.Filters.Blur = math.Round(img.Filters.Blur*10) / 10
+	}
+
+	if s := query.Get("sharpen"); s != "" {
+		img.Filters.Sharpen, err = strconv.ParseFloat(s, 64)
+		if err != nil || img.Filters.Sharpen < 0 || img.Filters.Sharpen > 10 {
+			return ErrInvalidSharpen
+		}
+		img.Filters.Sharpen = math.Round(img.Filters.Sharpen*10) / 10
+	}
+
+	return nil
+}
+
+// parseWatermark reads the watermark composited onto the image and its options;
+// whether the watermark exists is up to the service to check
+func (img *Imgmeta) parseWatermark(query url.Values) (err error) {
+	name := query.Get("wm")
+	if name == "" {
+		return nil
+	}
+	if !watermarkNameRegexp.MatchString(name) {
+		return ErrInvalidWatermark
+	}
+
+	wm := DefaultWatermark
+	wm.Name = name
+	if p := query.Get("wmpos"); p != "" {
+		if wm.Position, err = ParseGravity(p); err != nil || wm.Position == GravitySmart {
+			return ErrInvalidGravity
+		}
+	}
+
+	for _, option := range []struct {
+		key   string
+		value *float64
+	}{{"wmopacity", &wm.Opacity}, {"wmscale", &wm.Scale}} {
+		if v := query.Get(option.key); v != "" {
+			*option.value, err = strconv.ParseFloat(v, 64)
+			if err != nil || *option.value < 0 || *option.value > 1 {
+				return ErrInvalidWatermarkSize
+			}
+			*option.value = math.Round(*option.value*100) / 100
+		}
+	}
+
+	if m := query.Get("wmmargin"); m != "" {
+		wm.Margin, err = strconv.Atoi(m)
+		if err != nil || wm.Margin < 0 || wm.Margin > 1000 {
+			return ErrInvalidWatermarkSize
+		}
+	}
+
+	img.Watermark = &wm
+	return nil
+}
+
+// parseText reads the text drawn onto the image and its options;
+// whether the font exists is up to the service to check
+func (img *Imgmeta) parseText(query url.Values) (err error) {
+	text := strings.TrimSpace(query.Get("text"))
+	if text == "" {
+		return nil
+	}
+	if !utf8.ValidString(text) || utf8.RuneCountInString(text) > 100 {
+		return ErrInvalidText
 	}
 
-	img.Height, err = strconv.Atoi(size[1])
+	overlay := DefaultTextOverlay
+	overlay.Text = text
+	if f := query.Get("font"); f != "" {
+		if _, ok := bundledFonts[f]; !ok && !fontNameRegexp.MatchString(f) {
+			return ErrInvalidFont
+		}
+		overlay.Font = f
+	}
+
+	if s := query.Get("textsize"); s != "" {
+		overlay.Size, err = strconv.Atoi(s)
+		if err != nil || overlay.Size < 1 || overlay.Size > 500 {
+			return ErrInvalidSize
+		}
+	}
+
+	if c := query.Get("textcolor"); c != "" {
+		if overlay.Color, err = ParseColor(c); err != nil {
+			return err
+		}
+	}
+
+	if p := query.Get("textpos"); p != "" {
+		if overlay.Position, err = ParseGravity(p); err != nil || overlay.Position == GravitySmart {
+			return ErrInvalidGravity
+		}
+	}
+
+	if c := query.Get("textshadow"); c != "" {
+		shadow, err := ParseColor(c)
+		if err != nil {
+			return err
+		}
+		overlay.Shadow = &shadow
+	}
+
+	img.Text = &overlay
+	return nil
+}
+
+// parseFormat reads the output format; asking for the format of the original is the same as asking for none
+func (img *Imgmeta) parseFormat(query url.Values) (err error) {
+	if query.Get("format") == "" {
+		return nil
+	}
+
+	format, err := ParseFormat(query.Get("format"))
 	if err != nil {
-		return img, ErrInvalidResolution
+		return err
+	}
+	*img = img.WithFormat(format)
+	return nil
+}
+
+// parseEncoding reads the encoder options; those left out are filled by the EncodingPolicy of the service
+func (img *Imgmeta) parseEncoding(query url.Values) (err error) {
+	if q := query.Get("q"); q != "" {
+		img.Quality, err = strconv.Atoi(q)
+		if err != nil || img.Quality < 1 || img.Quality > 100 {
+			return ErrInvalidQuality
+		}
+	}
+
+	if p := query.Get("progressive"); p != "" {
+		img.Progressive, err = strconv.ParseBool(p)
+		if err != nil {
+			return ErrInvalidFlag
+		}
+	}
+
+	if s := query.Get("strip"); s != "" {
+		img.Strip, err = strconv.ParseBool(s)
+		if err != nil {
+			return ErrInvalidFlag
+		}
+	}
+
+	switch query.Get("icc") {
+	case "", "srgb":
+	case "keep":
+		img.KeepICC = true
+	default:
+		return ErrInvalidICC
+	}
+
+	if mb := query.Get("maxbytes"); mb != "" {
+		img.MaxBytes, err = strconv.Atoi(mb)
+		if err != nil || img.MaxBytes < 1 {
+			return ErrInvalidMaxBytes
+		}
 	}
 
-	return
+	return nil
 }
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"net/url"
+	"testing"
+)
+
+func Test_NewImageFromRequest(t *testing.T) {
+	tests := []struct {
+		query string
+		name  string
+		err   error
+	}{
+		{"", "landscape.jpg", nil},
+		{"size=300x200", "landscape_300x200.jpg", nil},
+		{"size=300x200&fit=inside", "landscape_300x200.jpg", nil},
+		{"size=300x200&fit=cover", "landscape_300x200_cover.jpg", nil},
+		{"size=300x200&fit=contain", "landscape_300x200_contain.jpg", nil},
+		{"size=300x200&fit=stretch", "", ErrInvalidFit},
+		{"size=300x200&fit=cover&gravity=center", "landscape_300x200_cover.jpg", nil},
+		{"size=300x200&fit=cover&gravity=south-east", "landscape_300x200_cover_g-south-east.jpg", nil},
+		{"size=300x200&fit=cover&fp=0.25,0.3333", "landscape_300x200_cover_fp-0.25-0.333.jpg", nil},
+		{"size=300x200&gravity=north", "landscape_300x200.jpg", nil},
+		{"size=300x200&gravity=bogus", "", ErrInvalidGravity},
+		{"size=300x&fit=stretch", "", ErrInvalidFit},
+		{"size=300x200&fit=contain&fp=2,2", "", ErrInvalidFocalPoint},
+		{"gravity=north&fp=0.5,0.5", "", ErrGravityFocalPoint},
+		{"size=300x200&fit=cover&gravity=smart", "landscape_300x200_cover_g-smart.jpg", nil},
+		{"size=300x200&fit=cover&gravity=up", "", ErrInvalidGravity},
+		{"size=300x200&fit=cover&fp=1.5,0", "", ErrInvalidFocalPoint},
+		{"size=300x200&fit=cover&fp=0.5", "", ErrInvalidFocalPoint},
+		{"size=300x200&fit=cover&fp=0.5,0.5&gravity=north", "", ErrGravityFocalPoint},
+		{"size=300x200&format=png", "landscape_300x200.jpg.png", nil},
+		{"size=300x200&format=jpg", "landscape_300x200.jpg", nil},
+		{"format=webp", "landscape.jpg.webp", nil},
+		{"format=jpeg", "landscape.jpg", nil},
+		{"format=tiff", "", ErrInvalidFormat},
+		{"fit=cover", "landscape.jpg", nil},
+		{"size=300x200&q=80&progressive=true&strip=1", "landscape_300x200_q80_progressive_strip.jpg", nil},
+		{"q=80", "landscape_q80.jpg", nil},
+		{"size=300x200&progressive=false&strip=false", "landscape_300x200.jpg", nil},
+		{"size=300x200&maxbytes=20000", "landscape_300x200_maxbytes20000.jpg", nil},
+		{"size=300x200&maxbytes=-1", "", ErrInvalidMaxBytes},
+		{"size=300x200&dpr=2", "landscape_600x400_dpr2.jpg", nil},
+		{"size=300x200&dpr=1.5", "landscape_450x300_dpr1.5.jpg", nil},
+		{"size=300x200&dpr=1", "landscape_300x200.jpg", nil},
+		{"size=300x200&dpr=5", "", ErrInvalidDPR},
+		{"size=300x200&dpr=x2", "", ErrInvalidDPR},
+		{"dpr=2", "", ErrDPRWithoutSize},
+		{"dpr=1&format=png", "", ErrDPRWithoutSize},
+		{"size=300x200&q=0", "", ErrInvalidQuality},
+		{"size=300x200&q=high", "", ErrInvalidQuality},
+		{"size=300x200&strip=yes", "", ErrInvalidFlag},
+		{"size=123xdf123a", "", ErrInvalidResolution},
+		{"size=300x", "landscape_300x0.jpg", nil},
+		{"size=x400&dpr=2", "landscape_0x800_dpr2.jpg", nil},
+		{"w=300", "landscape_300x0.jpg", nil},
+		{"w=300&h=200", "landscape_300x200.jpg", nil},
+		{"size=x", "", ErrInvalidResolution},
+		{"w=300&size=300x200", "", ErrSizeAndDimensions},
+		{"h=-4", "", ErrInvalidResolution},
+		{"size=0x200", "", ErrInvalidResolution},
+		{"rotate=90", "landscape_r90.jpg", nil},
+		{"size=300x200&rotate=270&flip=h", "landscape_300x200_r270_flip-h.jpg", nil},
+		{"flip=v&orient=false", "landscape_flip-v_noorient.jpg", nil},
+		{"orient=true", "landscape.jpg", nil},
+		{"rotate=45", "", ErrInvalidRotate},
+		{"rotate=360", "", ErrInvalidRotate},
+		{"flip=x", "", ErrInvalidFlip},
+		{"orient=no", "", ErrInvalidOrient},
+		{"crop=10,20,300,200", "landscape_crop-10-20-300-200.jpg", nil},
+		{"crop=10%25,20%25,50%25,33.333%25&w=300", "landscape_300x0_crop-10p-20p-50p-33.33p.jpg", nil},
+		{"crop=10,20,300", "", ErrInvalidCrop},
+		{"crop=10%25,20,300,200", "", ErrInvalidCrop},
+		{"crop=60%25,0%25,50%25,50%25", "", ErrInvalidCrop},
+		{"crop=10,20,0,200", "", ErrInvalidCrop},
+		{"size=300x200&sharpen=1&blur=2.55&contrast=-10&sepia=true&grayscale=1&brightness=20",
+			"landscape_300x200_grayscale_sepia_brightness20_contrast-10_blur2.6_sharpen1.jpg", nil},
+		{"grayscale=true", "landscape_grayscale.jpg", nil},
+		{"grayscale=false&brightness=0", "landscape.jpg", nil},
+		{"sepia=maybe", "", ErrInvalidColorFlag},
+		{"contrast=101", "", ErrInvalidBrightness},
+		{"blur=-1", "", ErrInvalidBlur},
+		{"blur=10.5", "", ErrInvalidBlur},
+		{"sharpen=x", "", ErrInvalidSharpen},
+		{"size=300x200&wm=logo.png", "landscape_300x200_wm-logo.png-south-east-o1-m0-s0.jpg", nil},
+		{"wm=logo.png&wmpos=north-west&wmopacity=0.505&wmmargin=10&wmscale=0.2", "landscape_wm-logo.png-north-west-o0.51-m10-s0.2.jpg", nil},
+		{"wmpos=north", "landscape.jpg", nil},
+		{"wm=../secret.png", "", ErrInvalidWatermark},
+		{"wm=logo.png&wmpos=smart", "", ErrInvalidGravity},
+		{"wm=logo.png&wmopacity=2", "", ErrInvalidWatermarkSize},
+		{"wm=logo.png&wmmargin=-1", "", ErrInvalidWatermarkSize},
+		{"text=%20&font=x", "landscape.jpg", nil},
+		{"text=NEW&font=../x.ttf", "", ErrInvalidFont},
+		{"text=NEW&textsize=0", "", ErrInvalidSize},
+		{"text=NEW&textcolor=fff", "", ErrInvalidColor},
+		{"text=NEW&textshadow=gggggg", "", ErrInvalidColor},
+		{"text=NEW&textpos=smart", "", ErrInvalidGravity},
+		{"size=400x400&fit=contain&pad=20&bg=FFFFFF", "landscape_400x400_contain_pad20_bg-ffffff.jpg", nil},
+		{"bg=00000080", "landscape_bg-00000080.jpg", nil},
+		{"size=400x400&pad=200", "", ErrInvalidPad},
+		{"pad=-1", "", ErrInvalidPad},
+		{"bg=white", "", ErrInvalidColor},
+		{"size=200x200&mask=circle&radius=0", "landscape_200x200_mask-circle.jpg", nil},
+		{"size=200x200&radius=16&bg=000000&format=png", "landscape_200x200_bg-000000_radius16.jpg.png", nil},
+		{"radius=1001", "", ErrInvalidRadius},
+		{"mask=square", "", ErrInvalidMask},
+		{"size=200x200&icc=keep", "landscape_200x200_icc-keep.jpg", nil},
+		{"size=200x200&icc=srgb", "landscape_200x200.jpg", nil},
+		{"icc=p3", "", ErrInvalidICC},
+		{"size=200x200&frame=2&format=png", "landscape_200x200_frame2.jpg.png", nil},
+		{"frame=0", "landscape_frame0.jpg", nil},
+		{"frame=-1", "", ErrInvalidFrame},
+		{"frame=10000", "", ErrInvalidFrame},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		img, err := NewImageFromRequest("landscape.jpg", query)
+		if err != tt.err {
+			t.Errorf("%q: expected error: %v, got error: %v", tt.query, tt.err, err)
+			continue
+		}
+		if err == nil && img.Name() != tt.name {
+			t.Errorf("%q: expected name: %v, got name: %v", tt.query, tt.name, img.Name())
+		}
+	}
+}
+
+func Test_Imgmeta_IsOriginal(t *testing.T) {
+	tests := []struct {
+		query      string
+		isOriginal bool
+	}{
+		{"", true},
+		{"format=jpg", true},
+		{"format=png", false},
+		{"size=10x10", false},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		img, err := NewImageFromRequest("landscape.jpg", query)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.query, err)
+			continue
+		}
+		if img.IsOriginal != tt.isOriginal {
+			t.Errorf("%q: expected is original: %v, got is original: %v", tt.query, tt.isOriginal, img.IsOriginal)
+		}
+	}
+}
+
+func Test_Imgmeta_WithOriginalSize(t *testing.T) {
+	tests := []struct {
+		img    Imgmeta
+		width  int
+		height int
+	}{
+		{Imgmeta{Width: 300}, 300, 150},
+		{Imgmeta{Height: 50}, 100, 50},
+		{Imgmeta{Width: 300, Height: 10}, 300, 10},
+		{Imgmeta{Width: 1}, 1, 1},
+	}
+
+	for _, tt := range tests {
+		img := tt.img.WithOriginalSize(400, 200)
+		if img.Width != tt.width || img.Height != tt.height {
+			t.Errorf("expected size: %vx%v, got size: %vx%v", tt.width, tt.height, img.Width, img.Height)
+		}
+	}
+}
+
+func Test_IsDerivativeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"landscape.jpg", false},
+		{"landscape_200x100.jpg", true},
+		{"landscape_200x100_cover_g-north.jpg", true},
+		{"landscape_200x100.jpg.webp", true},
+		{"landscape_200x100.png", false},
+		{"landscape2_200x100.jpg", false},
+		{"portrait_200x100.jpg", false},
+		{"landscape_q75_strip.jpg", true},
+		{"landscape_blur2.6.jpg", true},
+		{"landscape_2.jpg", false},
+		{"landscape_2_200x100.jpg", false},
+		{"landscape_2_200x100.jpg.webp", false},
+	}
+
+	for _, tt := range tests {
+		if actual := IsDerivativeName(tt.name, "landscape.jpg"); actual != tt.expected {
+			t.Errorf("%s: expected derivative: %v, got derivative: %v", tt.name, tt.expected, actual)
+		}
+	}
+}
+
+func Test_Crop_Rect(t *testing.T) {
+	tests := []struct {
+		crop string
+		rect image.Rectangle
+		err  error
+	}{
+		{"10,20,300,100", image.Rect(10, 20, 310, 120), nil},
+		{"0,0,400,200", image.Rect(0, 0, 400, 200), nil},
+		{"25%,50%,50%,50%", image.Rect(100, 100, 300, 200), nil},
+		{"200,0,201,100", image.Rectangle{}, ErrCropOutOfBounds},
+		{"0%,0%,0.1%,0.1%", image.Rectangle{}, ErrCropOutOfBounds},
+	}
+
+	for _, tt := range tests {
+		crop, err := ParseCrop(tt.crop)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", tt.crop, err)
+		}
+		rect, err := crop.Rect(400, 200)
+		if err != tt.err || rect != tt.rect {
+			t.Errorf("%q: expected rect: %v and error: %v, got rect: %v and error: %v", tt.crop, tt.rect, tt.err, rect, err)
+		}
+	}
+
+	// The crop is taken before scaling, so its aspect ratio is the one that is kept
+	crop, _ := ParseCrop("0,0,100,100")
+	out, err := NewGoResizer().Resize(testImage(t, 400, 200), Imgmeta{Original: "test.png", Width: 50, Height: 80, Crop: crop})
+	if err != nil {
+		t.Fatalf("failed to resize image: %s", err)
+	}
+	cfg, _, _ := image.DecodeConfig(bytes.NewReader(out))
+	if cfg.Width != 50 || cfg.Height != 50 {
+		t.Errorf("expected size: 50x50, got size: %vx%v", cfg.Width, cfg.Height)
+	}
+}
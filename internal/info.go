@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Info describes an original, for clients building crop UIs or validating uploads
+type Info struct {
+	Width       int         `json:"width"` // once upright, the coordinates crops are given in
+	Height      int         `json:"height"`
+	Format      Format      `json:"format"`
+	Size        int64       `json:"size"` // in bytes
+	ModTime     time.Time   `json:"mtime"`
+	Orientation int         `json:"orientation"` // EXIF orientation, 1 when upright
+	Camera      *CameraInfo `json:"camera,omitempty"`
+	ICC         bool        `json:"icc"` // whether the original embeds a color profile
+	Derivatives []string    `json:"derivatives"`
+}
+
+// CameraInfo is the EXIF data of the camera an original was shot with; missing tags are left empty
+type CameraInfo struct {
+	Make         string  `json:"make,omitempty"`
+	Model        string  `json:"model,omitempty"`
+	Lens         string  `json:"lens,omitempty"`
+	DateTime     string  `json:"date_time,omitempty"`     // as written by the camera, YYYY:MM:DD HH:MM:SS
+	ExposureTime string  `json:"exposure_time,omitempty"` // in seconds, as a fraction below one
+	FNumber      float64 `json:"f_number,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	FocalLength  float64 `json:"focal_length,omitempty"` // in millimeters
+}
+
+// NewInfo reads what there is to know about an original out of its content;
+// the size, modification time and derivatives are up to the store
+func NewInfo(data []byte) (Info, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Info{}, errors.New(fmt.Sprintf("failed to decode image config: %s", err))
+	}
+	md := readMetadata(data)
+	info := Info{
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		Format:      Format(format),
+		Orientation: exifOrientation(md.exif),
+		Camera:      readCameraInfo(md.exif),
+		ICC:         md.icc != nil,
+		Derivatives: []string{},
+	}
+	if exifOrientations[info.Orientation].rotate%180 == 90 {
+		info.Width, info.Height = info.Height, info.Width
+	}
+	return info, nil
+}
+
+// EXIF tags of camera data, in the first IFD or in the EXIF sub-IFD it points to
+const (
+	exifTagMake         = 0x010f
+	exifTagModel        = 0x0110
+	exifTagExifIFD      = 0x8769
+	exifTagExposureTime = 0x829a
+	exifTagFNumber      = 0x829d
+	exifTagISO          = 0x8827
+	exifTagDateTime     = 0x9003
+	exifTagFocalLength  = 0x920a
+	exifTagLens         = 0xa434
+)
+
+// exifTypeSizes maps the TIFF field types to the size of their values
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// exifEntry is a field of an IFD, with its value resolved wherever it's stored
+type exifEntry struct {
+	typ   uint16
+	count int
+	value []byte
+}
+
+// readExifIFD reads the fields of the IFD at offset in an EXIF payload, skipping those out of bounds
+func readExifIFD(exif []byte, order binary.ByteOrder, offset int) map[uint16]exifEntry {
+	entries := map[uint16]exifEntry{}
+	if offset < 8 || offset+2 > len(exif) {
+		return entries
+	}
+	count := int(order.Uint16(exif[offset:]))
+	for i := 0; i < count; i++ {
+		pos := offset + 2 + i*12
+		if pos+12 > len(exif) {
+			break
+		}
+		typ := order.Uint16(exif[pos+2:])
+		n := int(order.Uint32(exif[pos+4:]))
+		size, ok := exifTypeSizes[typ]
+		if !ok || n <= 0 || n > len(exif) {
+			continue
+		}
+		// Values of up to 4 bytes are stored in the field itself, larger ones at an offset
+		start := pos + 8
+		if size*n > 4 {
+			start = int(order.Uint32(exif[pos+8:]))
+		}
+		if start < 0 || start+size*n > len(exif) {
+			continue
+		}
+		entries[order.Uint16(exif[pos:])] = exifEntry{typ: typ, count: n, value: exif[start : start+size*n]}
+	}
+	return entries
+}
+
+func readCameraInfo(exif []byte) *CameraInfo {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(exif, []byte("II*\x00")):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(exif, []byte("MM\x00*")):
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	if len(exif) < 8 {
+		return nil
+	}
+
+	ifd := readExifIFD(exif, order, int(order.Uint32(exif[4:])))
+	sub := map[uint16]exifEntry{}
+	if e, ok := ifd[exifTagExifIFD]; ok && e.typ == 4 {
+		sub = readExifIFD(exif, order, int(order.Uint32(e.value)))
+	}
+
+	camera := CameraInfo{
+		Make:        exifString(ifd[exifTagMake]),
+		Model:       exifString(ifd[exifTagModel]),
+		Lens:        exifString(sub[exifTagLens]),
+		DateTime:    exifString(sub[exifTagDateTime]),
+		FNumber:     exifFloat(sub[exifTagFNumber], order),
+		FocalLength: exifFloat(sub[exifTagFocalLength], order),
+	}
+	if e, ok := sub[exifTagISO]; ok && e.typ == 3 {
+		camera.ISO = int(order.Uint16(e.value))
+	}
+	if e, ok := sub[exifTagExposureTime]; ok && e.typ == 5 {
+		num, den := order.Uint32(e.value), order.Uint32(e.value[4:])
+		switch {
+		case den == 0:
+		case num < den && num > 0 && den%num == 0:
+			camera.ExposureTime = fmt.Sprintf("1/%d", den/num)
+		default:
+			camera.ExposureTime = strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+		}
+	}
+
+	if camera == (CameraInfo{}) {
+		return nil
+	}
+	return &camera
+}
+
+func exifString(e exifEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// exifFloat reads an unsigned rational, rounded to 2 decimals
+func exifFloat(e exifEntry, order binary.ByteOrder) float64 {
+	if e.typ != 5 {
+		return 0
+	}
+	num, den := order.Uint32(e.value), order.Uint32(e.value[4:])
+	if den == 0 {
+		return 0
+	}
+	return math.Round(float64(num)/float64(den)*100) / 100
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_NewInfo(t *testing.T) {
+	// A little endian EXIF payload: make and orientation in the first IFD, exposure in the EXIF sub-IFD
+	var exif bytes.Buffer
+	le := binary.LittleEndian
+	field := func(tag, typ uint16, count, value uint32) {
+		binary.Write(&exif, le, tag)
+		binary.Write(&exif, le, typ)
+		binary.Write(&exif, le, []uint32{count, value})
+	}
+	exif.WriteString("II*\x00")
+	binary.Write(&exif, le, uint32(8))
+	binary.Write(&exif, le, uint16(3))
+	field(exifTagMake, 2, 6, 50)
+	field(0x0112, 3, 1, 6)
+	field(exifTagExifIFD, 4, 1, 56)
+	binary.Write(&exif, le, uint32(0))
+	exif.WriteString("Canon\x00")
+	binary.Write(&exif, le, uint16(3))
+	field(exifTagExposureTime, 5, 1, 98)
+	field(exifTagFNumber, 5, 1, 106)
+	field(exifTagISO, 3, 1, 200)
+	binary.Write(&exif, le, []uint32{0, 1, 250, 28, 10})
+
+	tests := []struct {
+		data     []byte
+		expected Info
+	}{
+		{testImage(t, 400, 200), Info{Width: 400, Height: 200, Format: FormatPNG, Orientation: 1}},
+		{writeMetadata(testImage(t, 400, 200), FormatPNG, metadata{exif: exif.Bytes(), icc: []byte("icc")}),
+			Info{Width: 200, Height: 400, Format: FormatPNG, Orientation: 6, ICC: true,
+				Camera: &CameraInfo{Make: "Canon", ExposureTime: "1/250", FNumber: 2.8, ISO: 200}}},
+	}
+
+	for _, tt := range tests {
+		info, err := NewInfo(tt.data)
+		if err != nil {
+			t.Fatalf("failed to read info: %s", err)
+		}
+		if info.Width != tt.expected.Width || info.Height != tt.expected.Height || info.Format != tt.expected.Format ||
+			info.Orientation != tt.expected.Orientation || info.ICC != tt.expected.ICC {
+			t.Errorf("expected info: %+v, got info: %+v", tt.expected, info)
+		}
+		if fmt.Sprint(info.Camera) != fmt.Sprint(tt.expected.Camera) {
+			t.Errorf("expected camera: %+v, got camera: %+v", tt.expected.Camera, info.Camera)
+		}
+	}
+}
+
+func Test_RedisCachedLocalImageStore_Info(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatalf("failed to create the images directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	// Another original sharing the name of photo.jpg, with a derivative of its own
+	for _, name := range []string{"photo.jpg", "photo_300x200.jpg", "photo_q75_strip.jpg.png", "photo_2.jpg", "photo_2_300x200.jpg"} {
+		ioutil.WriteFile(filepath.Join(dir, name), testImage(t, 400, 200), 0644)
+	}
+
+	info, err := RedisCachedLocalImageStore{basepath: dir}.Info("photo.jpg")
+	if err != nil {
+		t.Fatalf("failed to read info: %s", err)
+	}
+	if e, a := []string{"photo_300x200.jpg", "photo_q75_strip.jpg.png"}, info.Derivatives; fmt.Sprint(e) != fmt.Sprint(a) {
+		t.Errorf("expected derivatives: %v, got derivatives: %v", e, a)
+	}
+}
@@ -0,0 +1,467 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"io"
+	"math"
+)
+
+// The standard library only writes baseline JPEGs; encodeProgressiveJPEG writes progressive ones,
+// using spectral selection: a first scan carries the DC coefficients of every block, so that a coarse
+// preview can be painted early, and the following scans refine it with bands of AC coefficients.
+
+// zigzag maps the position of a coefficient in the encoding order to its position in the 8x8 block
+var zigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// Quantization tables from the JPEG specification (Annex K), in natural order
+var baseQuantTables = [2][64]int{
+	{
+		16, 11, 10, 16, 24, 40, 51, 61,
+		12, 12, 14, 19, 26, 58, 60, 55,
+		14, 13, 16, 24, 40, 57, 69, 56,
+		14, 17, 22, 29, 51, 87, 80, 62,
+		18, 22, 37, 56, 68, 109, 103, 77,
+		24, 35, 55, 64, 81, 104, 113, 92,
+		49, 64, 78, 87, 103, 121, 120, 101,
+		72, 92, 95, 98, 112, 100, 103, 99,
+	},
+	{
+		17, 18, 24, 47, 99, 99, 99, 99,
+		18, 21, 26, 66, 99, 99, 99, 99,
+		24, 26, 56, 99, 99, 99, 99, 99,
+		47, 66, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// huffmanSpec is a Huffman table as stored in a DHT segment
+type huffmanSpec struct {
+	counts [16]byte // number of codes of each length, from 1 to 16 bits
+	values []byte
+}
+
+// Huffman tables from the JPEG specification (Annex K): DC luminance, DC chrominance, AC luminance, AC chrominance.
+// The AC tables hold the EOB (0x00) and ZRL (0xf0) symbols progressive scans use as well.
+var huffmanSpecs = [4]huffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// huffmanCode is the code of a symbol, right aligned in bits
+type huffmanCode struct {
+	bits uint32
+	size uint8
+}
+
+// codes generates the canonical codes of a Huffman table, indexed by symbol
+func (h huffmanSpec) codes() [256]huffmanCode {
+	var codes [256]huffmanCode
+	var code uint32
+	k := 0
+	for length := 1; length <= 16; length++ {
+		for i := 0; i < int(h.counts[length-1]); i++ {
+			codes[h.values[k]] = huffmanCode{bits: code, size: uint8(length)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// progressiveScan describes one scan of a progressive JPEG: a band of coefficients of some components
+type progressiveScan struct {
+	components []int
+	start, end int
+}
+
+// progressiveScans is the scan script; the DC scan must come first and interleave all components
+var progressiveScans = []progressiveScan{
+	{components: []int{0, 1, 2}, start: 0, end: 0},
+	{components: []int{0}, start: 1, end: 5},
+	{components: []int{2}, start: 1, end: 63},
+	{components: []int{1}, start: 1, end: 63},
+	{components: []int{0}, start: 6, end: 63},
+}
+
+// scaledQuantTables scales the standard tables to a quality, as libjpeg and the standard library do
+func scaledQuantTables(quality int) [2][64]int {
+	quality = clampInt(quality, 1, 100)
+	var factor int
+	if quality < 50 {
+		factor = 5000 / quality
+	} else {
+		factor = 200 - 2*quality
+	}
+
+	var tables [2][64]int
+	for t := range baseQuantTables {
+		for i, q := range baseQuantTables[t] {
+			tables[t][i] = clampInt((q*factor+50)/100, 1, 255)
+		}
+	}
+	return tables
+}
+
+// jpegComponent holds the quantized coefficients of one color component
+type jpegComponent struct {
+	id           byte
+	sampling     int // horizontal and vertical sampling factor
+	table        int // index of the quantization and Huffman tables
+	blocksWide   int // blocks per row, including the padding of the last MCU
+	blocks       [][64]int32
+	usedW, usedH int // blocks covering the image itself, which non-interleaved scans go through
+}
+
+func encodeProgressiveJPEG(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > 65535 || b.Dy() > 65535 {
+		return errors.New("jpeg: image size out of range")
+	}
+
+	tables := scaledQuantTables(quality)
+	components := jpegComponents(toRGBA(img), tables)
+
+	bw := bufio.NewWriter(w)
+	writeJPEGHeaders(bw, b.Dx(), b.Dy(), tables, components)
+
+	var huffCodes [4][256]huffmanCode
+	for i, spec := range huffmanSpecs {
+		huffCodes[i] = spec.codes()
+	}
+
+	mcusWide := (b.Dx() + 15) / 16
+	mcusHigh := (b.Dy() + 15) / 16
+	for _, scan := range progressiveScans {
+		writeScanHeader(bw, scan, components)
+		e := entropyWriter{w: bw}
+
+		if scan.start == 0 {
+			// DC scan, interleaved: each MCU holds 2x2 luma blocks and one block of each chroma
+			var predictors [3]int32
+			for my := 0; my < mcusHigh; my++ {
+				for mx := 0; mx < mcusWide; mx++ {
+					for _, ci := range scan.components {
+						c := &components[ci]
+						for by := 0; by < c.sampling; by++ {
+							for bx := 0; bx < c.sampling; bx++ {
+								block := &c.blocks[(my*c.sampling+by)*c.blocksWide+mx*c.sampling+bx]
+								dc := block[0]
+								e.emitValue(huffCodes[c.table], dc-predictors[ci])
+								predictors[ci] = dc
+							}
+						}
+					}
+				}
+			}
+		} else {
+			// AC scan, non interleaved: blocks are visited in raster order, leaving out the MCU padding
+			c := &components[scan.components[0]]
+			codes := huffCodes[2+c.table]
+			for by := 0; by < c.usedH; by++ {
+				for bx := 0; bx < c.usedW; bx++ {
+					block := &c.blocks[by*c.blocksWide+bx]
+					run := 0
+					for k := scan.start; k <= scan.end; k++ {
+						v := block[zigzag[k]]
+						if v == 0 {
+							run++
+							continue
+						}
+						for ; run > 15; run -= 16 {
+							e.emit(codes[0xf0])
+						}
+						e.emitRunValue(codes, run, v)
+						run = 0
+					}
+					if run > 0 {
+						// EOB0: the rest of the band of this block is zero
+						e.emit(codes[0x00])
+					}
+				}
+			}
+		}
+		e.flush()
+	}
+
+	bw.Write([]byte{0xff, 0xd9})
+	return bw.Flush()
+}
+
+// jpegComponents converts an image to YCbCr 4:2:0 and computes the quantized DCT coefficients of its blocks
+func jpegComponents(img *image.RGBA, tables [2][64]int) []jpegComponent {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	mcusWide, mcusHigh := (width+15)/16, (height+15)/16
+
+	components := []jpegComponent{
+		{id: 1, sampling: 2, table: 0},
+		{id: 2, sampling: 1, table: 1},
+		{id: 3, sampling: 1, table: 1},
+	}
+	for i := range components {
+		c := &components[i]
+		c.blocksWide = mcusWide * c.sampling
+		c.blocks = make([][64]int32, c.blocksWide*mcusHigh*c.sampling)
+		compW := (width*c.sampling + 1) / 2
+		compH := (height*c.sampling + 1) / 2
+		c.usedW, c.usedH = (compW+7)/8, (compH+7)/8
+	}
+
+	// pixel returns the YCbCr of a pixel, repeating the edges of the image over the padding
+	pixel := func(x, y int) (float64, float64, float64) {
+		p := img.Pix[clampInt(y, 0, height-1)*img.Stride+clampInt(x, 0, width-1)*4:]
+		r, g, b := float64(p[0]), float64(p[1]), float64(p[2])
+		return 0.299*r + 0.587*g + 0.114*b,
+			-0.168736*r - 0.331264*g + 0.5*b + 128,
+			0.5*r - 0.418688*g - 0.081312*b + 128
+	}
+
+	var samples [3][64]float64
+	for my := 0; my < mcusHigh; my++ {
+		for mx := 0; mx < mcusWide; mx++ {
+			// Luma: 2x2 blocks per MCU
+			for by := 0; by < 2; by++ {
+				for bx := 0; bx < 2; bx++ {
+					for i := 0; i < 64; i++ {
+						samples[0][i], _, _ = pixel(mx*16+bx*8+i%8, my*16+by*8+i/8)
+					}
+					c := &components[0]
+					quantizeBlock(&c.blocks[(my*2+by)*c.blocksWide+mx*2+bx], &samples[0], &tables[0])
+				}
+			}
+			// Chroma: one block per MCU, each sample averaging 2x2 pixels
+			for i := 0; i < 64; i++ {
+				x, y := mx*16+(i%8)*2, my*16+(i/8)*2
+				var cb, cr float64
+				for d := 0; d < 4; d++ {
+					_, pcb, pcr := pixel(x+d%2, y+d/2)
+					cb += pcb
+					cr += pcr
+				}
+				samples[1][i], samples[2][i] = cb/4, cr/4
+			}
+			for ci := 1; ci < 3; ci++ {
+				c := &components[ci]
+				quantizeBlock(&c.blocks[my*c.blocksWide+mx], &samples[ci], &tables[1])
+			}
+		}
+	}
+	return components
+}
+
+// dctCosines holds cos((2x+1)uπ/16) at [u][x]
+var dctCosines = func() (c [8][8]float64) {
+	for u := 0; u < 8; u++ {
+		for x := 0; x < 8; x++ {
+			c[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / 16)
+		}
+	}
+	return c
+}()
+
+// quantizeBlock computes the forward DCT of 64 samples and quantizes it
+func quantizeBlock(dst *[64]int32, samples *[64]float64, table *[64]int) {
+	var rows [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for x := 0; x < 8; x++ {
+				sum += (samples[y*8+x] - 128) * dctCosines[u][x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var sum float64
+			for y := 0; y < 8; y++ {
+				sum += rows[y*8+u] * dctCosines[v][y]
+			}
+			cu, cv := 1.0, 1.0
+			if u == 0 {
+				cu = math.Sqrt2 / 2
+			}
+			if v == 0 {
+				cv = math.Sqrt2 / 2
+			}
+			coef := sum * cu * cv / 4
+			dst[v*8+u] = int32(math.Round(coef / float64(table[v*8+u])))
+		}
+	}
+}
+
+func writeJPEGHeaders(w *bufio.Writer, width, height int, tables [2][64]int, components []jpegComponent) {
+	// SOI, then a JFIF APP0 segment
+	w.Write([]byte{0xff, 0xd8})
+	w.Write([]byte{0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 0, 0, 1, 0, 1, 0, 0})
+
+	// DQT, written in zigzag order
+	w.Write([]byte{0xff, 0xdb, 0, 2 + 2*65})
+	for t := range tables {
+		w.WriteByte(byte(t))
+		for k := 0; k < 64; k++ {
+			w.WriteByte(byte(tables[t][zigzag[k]]))
+		}
+	}
+
+	// SOF2: progressive, Huffman coded
+	w.Write([]byte{0xff, 0xc2, 0, byte(8 + 3*len(components)), 8,
+		byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(components))})
+	for _, c := range components {
+		w.Write([]byte{c.id, byte(c.sampling<<4 | c.sampling), byte(c.table)})
+	}
+
+	// DHT
+	length := 2
+	for _, spec := range huffmanSpecs {
+		length += 1 + 16 + len(spec.values)
+	}
+	w.Write([]byte{0xff, 0xc4, byte(length >> 8), byte(length)})
+	for i, spec := range huffmanSpecs {
+		// Tables 0 and 1 are DC (class 0), 2 and 3 are AC (class 1)
+		w.WriteByte(byte(i/2<<4 | i%2))
+		w.Write(spec.counts[:])
+		w.Write(spec.values)
+	}
+}
+
+func writeScanHeader(w *bufio.Writer, scan progressiveScan, components []jpegComponent) {
+	w.Write([]byte{0xff, 0xda, 0, byte(6 + 2*len(scan.components)), byte(len(scan.components))})
+	for _, ci := range scan.components {
+		c := components[ci]
+		w.Write([]byte{c.id, byte(c.table<<4 | c.table)})
+	}
+	w.Write([]byte{byte(scan.start), byte(scan.end), 0})
+}
+
+// entropyWriter writes Huffman coded data, stuffing a zero byte after every 0xff
+type entropyWriter struct {
+	w     *bufio.Writer
+	bits  uint32
+	nbits uint
+}
+
+func (e *entropyWriter) writeBits(bits uint32, n uint) {
+	e.bits = e.bits<<n | bits&(1<<n-1)
+	e.nbits += n
+	for e.nbits >= 8 {
+		b := byte(e.bits >> (e.nbits - 8))
+		e.w.WriteByte(b)
+		if b == 0xff {
+			e.w.WriteByte(0)
+		}
+		e.nbits -= 8
+	}
+}
+
+func (e *entropyWriter) emit(code huffmanCode) {
+	e.writeBits(code.bits, uint(code.size))
+}
+
+// magnitude returns the size category of a coefficient and its additional bits
+func magnitude(v int32) (uint, uint32) {
+	abs := v
+	if v < 0 {
+		abs = -v
+		v--
+	}
+	var size uint
+	for ; abs > 0; abs >>= 1 {
+		size++
+	}
+	return size, uint32(v)
+}
+
+// emitValue codes a DC difference: its size category, then its bits
+func (e *entropyWriter) emitValue(codes [256]huffmanCode, v int32) {
+	size, bits := magnitude(v)
+	e.emit(codes[size])
+	e.writeBits(bits, size)
+}
+
+// emitRunValue codes an AC coefficient preceded by run zeros
+func (e *entropyWriter) emitRunValue(codes [256]huffmanCode, run int, v int32) {
+	size, bits := magnitude(v)
+	e.emit(codes[byte(run<<4)|byte(size)])
+	e.writeBits(bits, size)
+}
+
+// flush pads the last byte of a scan with ones
+func (e *entropyWriter) flush() {
+	if e.nbits > 0 {
+		e.writeBits(0x7f, 8-e.nbits)
+	}
+	e.bits = 0
+}
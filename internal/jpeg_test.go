@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"bytes"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func Test_encodeProgressiveJPEG(t *testing.T) {
+	src, err := png.Decode(bytes.NewReader(testImage(t, 123, 45)))
+	if err != nil {
+		t.Fatalf("failed to decode test image: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeProgressiveJPEG(&buf, src, 75); err != nil {
+		t.Fatalf("failed to encode image: %s", err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte{0xff, 0xc2}) {
+		t.Error("expected a progressive frame marker")
+	}
+
+	out, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatalf("failed to decode progressive image: %s", err)
+	}
+	if e, a := src.Bounds().Size(), out.Bounds().Size(); e != a {
+		t.Errorf("expected size: %v, got size: %v", e, a)
+	}
+
+	// The gradient must survive the encoding, give or take compression artifacts
+	r, g, _, _ := out.At(100, 40).RGBA()
+	if r>>8 < 190 || r>>8 > 225 || g>>8 < 210 || g>>8 > 245 {
+		t.Errorf("expected color close to the original, got: %v", out.At(100, 40))
+	}
+}
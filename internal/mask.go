@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+var (
+	ErrInvalidRadius = errors.New("radius must be an integer between 0 and 1000")
+	ErrInvalidMask   = errors.New("mask must be circle")
+)
+
+// Mask is a shape the image is cut to; what's outside is transparent, or flattened onto
+// the background for formats without alpha
+type Mask string
+
+const (
+	MaskCircle Mask = "circle" // the ellipse inscribed in the image, a circle for square ones
+)
+
+func ParseMask(s string) (Mask, error) {
+	switch mask := Mask(s); mask {
+	case MaskCircle:
+		return mask, nil
+	}
+	return "", ErrInvalidMask
+}
+
+// applyMask cuts img to its mask and rounds its corners, in place; edges are anti-aliased
+// by using the distance of each pixel center to the edge as its coverage
+func applyMask(img *image.RGBA, mask Mask, radius int) {
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	r := math.Min(float64(radius), math.Min(w, h)/2)
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			px, py := float64(x)+0.5, float64(y)+0.5
+			coverage := 1.0
+
+			if mask == MaskCircle {
+				// Distance to the ellipse, approximated by scaling its normalized distance
+				rx, ry := w/2, h/2
+				dx, dy := (px-rx)/rx, (py-ry)/ry
+				d := (math.Sqrt(dx*dx+dy*dy) - 1) * math.Min(rx, ry)
+				coverage = math.Min(coverage, clampFloat(0.5-d, 0, 1))
+			}
+
+			if r > 0 {
+				// Only pixels in the corner squares are affected
+				cx := clampFloat(px, r, w-r)
+				cy := clampFloat(py, r, h-r)
+				if cx != px && cy != py {
+					d := math.Hypot(px-cx, py-cy) - r
+					coverage = math.Min(coverage, clampFloat(0.5-d, 0, 1))
+				}
+			}
+
+			if coverage < 1 {
+				p := img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y):]
+				for c := 0; c < 4; c++ {
+					p[c] = uint8(math.Round(float64(p[c]) * coverage))
+				}
+			}
+		}
+	}
+}
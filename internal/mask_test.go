@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"testing"
+)
+
+func Test_GoResizer_mask(t *testing.T) {
+	var in bytes.Buffer
+	src := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	png.Encode(&in, src)
+
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	tests := []struct {
+		img    Imgmeta
+		center color.Color
+		corner color.Color
+		edge   color.Color // middle of the top edge
+	}{
+		{Imgmeta{Radius: 20}, red, color.NRGBA{}, red},
+		{Imgmeta{Mask: MaskCircle}, red, color.NRGBA{}, red},
+		{Imgmeta{Mask: MaskCircle, Format: FormatJPEG}, red, DefaultBackground, red},
+		{Imgmeta{Radius: 20, Format: FormatJPEG, Background: &blue}, red, blue, red},
+	}
+
+	for _, tt := range tests {
+		tt.img.Original = "test.png"
+		out, err := NewGoResizer().Resize(in.Bytes(), tt.img)
+		if err != nil {
+			t.Fatalf("failed to resize image: %s", err)
+		}
+		dst, _, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("failed to decode image: %s", err)
+		}
+		for _, p := range []struct {
+			at       image.Point
+			expected color.Color
+		}{{image.Pt(50, 50), tt.center}, {image.Pt(1, 1), tt.corner}, {image.Pt(50, 1), tt.edge}} {
+			if !similarColors(dst.At(p.at.X, p.at.Y), p.expected) {
+				t.Errorf("%s: expected color: %v at %v, got color: %v", tt.img.Name(), p.expected, p.at, dst.At(p.at.X, p.at.Y))
+			}
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package internal
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegICCHeader  = []byte("ICC_PROFILE\x00")
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// metadata holds the EXIF and ICC profile payloads of an image; the Go encoders write neither,
+// so they are carried over from the original by hand when they aren't stripped.
+type metadata struct {
+	exif []byte // TIFF structure, without the JPEG "Exif" header
+	icc  []byte
+}
+
+// readMetadata extracts the metadata of a JPEG or PNG image; other formats have none we know of
+func readMetadata(data []byte) metadata {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return readJPEGMetadata(data)
+	case bytes.HasPrefix(data, pngSignature):
+		return readPNGMetadata(data)
+	}
+	return metadata{}
+}
+
+// jpegSegments calls fn with the marker and payload of every segment before the image data
+func jpegSegments(data []byte, fn func(marker byte, payload []byte)) {
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			return
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// Fill byte
+			pos++
+			continue
+		}
+		if marker == 0xda || marker == 0xd9 {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return
+		}
+		fn(marker, data[pos+4:pos+2+length])
+		pos += 2 + length
+	}
+}
+
+func readJPEGMetadata(data []byte) (md metadata) {
+	var iccChunks [][]byte
+	jpegSegments(data, func(marker byte, payload []byte) {
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(payload, jpegExifHeader) && md.exif == nil:
+			md.exif = payload[len(jpegExifHeader):]
+		case marker == 0xe2 && bytes.HasPrefix(payload, jpegICCHeader) && len(payload) > len(jpegICCHeader)+2:
+			// Profiles are split in numbered chunks, which normally come in order
+			seq := int(payload[len(jpegICCHeader)])
+			for len(iccChunks) < seq {
+				iccChunks = append(iccChunks, nil)
+			}
+			if seq > 0 {
+				iccChunks[seq-1] = payload[len(jpegICCHeader)+2:]
+			}
+		}
+	})
+	if len(iccChunks) > 0 {
+		md.icc = bytes.Join(iccChunks, nil)
+	}
+	return md
+}
+
+// pngChunks calls fn with the type and data of every chunk of a PNG image
+func pngChunks(data []byte, fn func(typ string, chunk []byte)) {
+	for pos := len(pngSignature); pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if length < 0 || pos+12+length > len(data) {
+			return
+		}
+		fn(string(data[pos+4:pos+8]), data[pos+8:pos+8+length])
+		pos += 12 + length
+	}
+}
+
+func readPNGMetadata(data []byte) (md metadata) {
+	pngChunks(data, func(typ string, chunk []byte) {
+		switch typ {
+		case "eXIf":
+			md.exif = chunk
+		case "iCCP":
+			// Profile name, null separator, compression method, zlib stream
+			if i := bytes.IndexByte(chunk, 0); i >= 0 && i+2 <= len(chunk) {
+				if r, err := zlib.NewReader(bytes.NewReader(chunk[i+2:])); err == nil {
+					md.icc, _ = ioutil.ReadAll(r)
+				}
+			}
+		}
+	})
+	return md
+}
+
+// exifOrientationTag locates the Orientation tag in the first IFD of an EXIF payload, returning the
+// byte order and the offset of its value; the offset is -1 when there is none.
+func exifOrientationTag(exif []byte) (binary.ByteOrder, int) {
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(exif, []byte("II*\x00")):
+		order = binary.LittleEndian
+	case bytes.HasPrefix(exif, []byte("MM\x00*")):
+		order = binary.BigEndian
+	default:
+		return nil, -1
+	}
+	if len(exif) < 8 {
+		return nil, -1
+	}
+	ifd := int(order.Uint32(exif[4:]))
+	if ifd < 8 || ifd+2 > len(exif) {
+		return nil, -1
+	}
+	count := int(order.Uint16(exif[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(exif) {
+			return nil, -1
+		}
+		// Orientation is a single SHORT, stored in the first bytes of the value field
+		if order.Uint16(exif[entry:]) == 0x0112 && order.Uint16(exif[entry+2:]) == 3 {
+			return order, entry + 8
+		}
+	}
+	return nil, -1
+}
+
+// exifOrientation reads the Orientation tag of an EXIF payload, 1 (upright) when there is none
+func exifOrientation(exif []byte) int {
+	order, pos := exifOrientationTag(exif)
+	if pos < 0 {
+		return 1
+	}
+	if orientation := int(order.Uint16(exif[pos:])); orientation >= 1 && orientation <= 8 {
+		return orientation
+	}
+	return 1
+}
+
+// withExifOrientation returns a copy of an EXIF payload with its Orientation tag, if any, set to orientation
+func withExifOrientation(exif []byte, orientation int) []byte {
+	order, pos := exifOrientationTag(exif)
+	if pos < 0 {
+		return exif
+	}
+	out := append([]byte(nil), exif...)
+	order.PutUint16(out[pos:], uint16(orientation))
+	return out
+}
+
+// carriesMetadata tells whether writeMetadata can write into images of the given format
+func carriesMetadata(format Format) bool {
+	return format == FormatJPEG || format == FormatPNG
+}
+
+// writeMetadata inserts metadata into an image freshly encoded in the given format;
+// formats we can't write metadata into are returned unchanged.
+func writeMetadata(data []byte, format Format, md metadata) []byte {
+	if md.exif == nil && md.icc == nil {
+		return data
+	}
+	switch format {
+	case FormatJPEG:
+		return writeJPEGMetadata(data, md)
+	case FormatPNG:
+		return writePNGMetadata(data, md)
+	}
+	return data
+}
+
+func writeJPEGMetadata(data []byte, md metadata) []byte {
+	var segments bytes.Buffer
+	writeSegment := func(marker byte, parts ...[]byte) {
+		length := 2
+		for _, p := range parts {
+			length += len(p)
+		}
+		segments.Write([]byte{0xff, marker, byte(length >> 8), byte(length)})
+		for _, p := range parts {
+			segments.Write(p)
+		}
+	}
+
+	if md.exif != nil && len(md.exif)+len(jpegExifHeader) <= 65533 {
+		writeSegment(0xe1, jpegExifHeader, md.exif)
+	}
+	if md.icc != nil {
+		const chunkSize = 65519
+		count := (len(md.icc) + chunkSize - 1) / chunkSize
+		for i := 0; i < count && count < 256; i++ {
+			end := minInt(len(md.icc), (i+1)*chunkSize)
+			writeSegment(0xe2, jpegICCHeader, []byte{byte(i + 1), byte(count)}, md.icc[i*chunkSize:end])
+		}
+	}
+
+	// Metadata goes after the JFIF segment when there is one, right after SOI otherwise
+	pos := 2
+	if len(data) > 6 && data[2] == 0xff && data[3] == 0xe0 {
+		pos = 4 + int(binary.BigEndian.Uint16(data[4:]))
+	}
+
+	out := make([]byte, 0, len(data)+segments.Len())
+	out = append(out, data[:pos]...)
+	out = append(out, segments.Bytes()...)
+	return append(out, data[pos:]...)
+}
+
+func writePNGMetadata(data []byte, md metadata) []byte {
+	var chunks bytes.Buffer
+	writeChunk := func(typ string, chunk []byte) {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(chunk)))
+		chunks.Write(length[:])
+		crc := crc32.NewIEEE()
+		crc.Write([]byte(typ))
+		crc.Write(chunk)
+		chunks.WriteString(typ)
+		chunks.Write(chunk)
+		binary.Write(&chunks, binary.BigEndian, crc.Sum32())
+	}
+
+	if md.icc != nil {
+		var compressed bytes.Buffer
+		compressed.WriteString("ICC profile\x00\x00")
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(md.icc)
+		zw.Close()
+		writeChunk("iCCP", compressed.Bytes())
+	}
+	if md.exif != nil {
+		writeChunk("eXIf", md.exif)
+	}
+
+	// Both chunks must come before the image data; right after IHDR is always fine
+	pos := len(pngSignature) + 12 + 13
+	if len(data) < pos {
+		return data
+	}
+	out := make([]byte, 0, len(data)+chunks.Len())
+	out = append(out, data[:pos]...)
+	out = append(out, chunks.Bytes()...)
+	return append(out, data[pos:]...)
+}
@@ -0,0 +1,29 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func Test_metadata(t *testing.T) {
+	md := metadata{exif: []byte("MM\x00\x2a\x00\x00\x00\x08"), icc: bytes.Repeat([]byte("icc"), 30000)}
+
+	var jpg bytes.Buffer
+	jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil)
+	var pngBuf bytes.Buffer
+	png.Encode(&pngBuf, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+
+	for format, data := range map[Format][]byte{FormatJPEG: jpg.Bytes(), FormatPNG: pngBuf.Bytes()} {
+		out := writeMetadata(data, format, md)
+		if _, _, err := image.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("%s: failed to decode image with metadata: %s", format, err)
+		}
+		read := readMetadata(out)
+		if !bytes.Equal(read.exif, md.exif) || !bytes.Equal(read.icc, md.icc) {
+			t.Errorf("%s: expected metadata to survive a round trip", format)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+)
+
+// exifOrientations maps the EXIF orientations to the transformation that makes the image upright:
+// a horizontal flip, then a clockwise rotation
+var exifOrientations = map[int]struct {
+	flip   bool
+	rotate int
+}{
+	1: {false, 0},
+	2: {true, 0},
+	3: {false, 180},
+	4: {true, 180},
+	5: {true, 270},
+	6: {false, 90},
+	7: {true, 90},
+	8: {false, 270},
+}
+
+// orient makes src upright according to its EXIF orientation, unless img ignores it,
+// then applies the rotation and flip img asks for
+func orient(src *image.RGBA, img Imgmeta, orientation int) *image.RGBA {
+	if !img.NoOrient {
+		t := exifOrientations[orientation]
+		if t.flip {
+			src = flipHorizontal(src)
+		}
+		src = rotate(src, t.rotate)
+	}
+
+	src = rotate(src, img.Rotate)
+	switch img.Flip {
+	case FlipHorizontal:
+		src = flipHorizontal(src)
+	case FlipVertical:
+		src = flipVertical(src)
+	}
+	return src
+}
+
+// swapsAxes tells whether the original of img, with the given EXIF orientation, ends up transposed
+func (img Imgmeta) swapsAxes(orientation int) bool {
+	degrees := img.Rotate
+	if !img.NoOrient {
+		degrees += exifOrientations[orientation].rotate
+	}
+	return degrees%180 == 90
+}
+
+// SourceSize reads the size of the region of an original a derivative is made of:
+// the original once oriented, rotated, flipped and cropped as img asks; every frame of a GIF has the same size
+func SourceSize(data []byte, img Imgmeta) (width, height int, err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, decodeError{err}
+	}
+	width, height = cfg.Width, cfg.Height
+	if img.swapsAxes(exifOrientation(readMetadata(data).exif)) {
+		width, height = height, width
+	}
+	if img.Crop != nil {
+		r, err := img.Crop.Rect(width, height)
+		if err != nil {
+			return 0, 0, err
+		}
+		width, height = r.Dx(), r.Dy()
+	}
+	return width, height, nil
+}
+
+// rotate turns src clockwise by a multiple of 90 degrees
+func rotate(src *image.RGBA, degrees int) *image.RGBA {
+	for ; degrees > 0; degrees -= 90 {
+		src = rotate90(src)
+	}
+	return src
+}
+
+func rotate90(src *image.RGBA) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			s := src.PixOffset(b.Min.X+x, b.Min.Y+y)
+			d := dst.PixOffset(b.Dy()-1-y, x)
+			copy(dst.Pix[d:d+4], src.Pix[s:s+4])
+		}
+	}
+	return dst
+}
+
+func flipHorizontal(src *image.RGBA) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			s := src.PixOffset(b.Min.X+x, b.Min.Y+y)
+			d := dst.PixOffset(b.Dx()-1-x, y)
+			copy(dst.Pix[d:d+4], src.Pix[s:s+4])
+		}
+	}
+	return dst
+}
+
+func flipVertical(src *image.RGBA) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		s := src.PixOffset(b.Min.X, b.Min.Y+y)
+		d := dst.PixOffset(0, b.Dy()-1-y)
+		copy(dst.Pix[d:d+b.Dx()*4], src.Pix[s:s+b.Dx()*4])
+	}
+	return dst
+}
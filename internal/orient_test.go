@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func Test_orient(t *testing.T) {
+	// A landscape image its EXIF tells to turn 90 degrees clockwise
+	exif := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	in := writeMetadata(testImage(t, 400, 200), FormatPNG, metadata{exif: exif})
+	if e, a := 6, exifOrientation(readMetadata(in).exif); e != a {
+		t.Fatalf("expected orientation: %v, got orientation: %v", e, a)
+	}
+
+	tests := []struct {
+		img    Imgmeta
+		width  int
+		height int
+	}{
+		{Imgmeta{Width: 100, Height: 100}, 50, 100},
+		{Imgmeta{Width: 100, Height: 100, NoOrient: true}, 100, 50},
+		{Imgmeta{Width: 100, Height: 100, Rotate: 90}, 100, 50},
+		{Imgmeta{Width: 100, Height: 100, Rotate: 270, Flip: FlipHorizontal}, 100, 50},
+	}
+
+	for _, tt := range tests {
+		tt.img.Original = "test.png"
+		width, height, err := SourceSize(in, tt.img)
+		if err != nil {
+			t.Fatalf("failed to read the oriented size: %s", err)
+		}
+		if (width > height) != (tt.width > tt.height) {
+			t.Errorf("%v: expected oriented size to be landscape: %v, got size: %vx%v", tt.img.Name(), tt.width > tt.height, width, height)
+		}
+
+		out, err := NewGoResizer().Resize(in, tt.img)
+		if err != nil {
+			t.Fatalf("failed to resize image: %s", err)
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("failed to decode resized image: %s", err)
+		}
+		if cfg.Width != tt.width || cfg.Height != tt.height {
+			t.Errorf("%v: expected size: %vx%v, got size: %vx%v", tt.img.Name(), tt.width, tt.height, cfg.Width, cfg.Height)
+		}
+	}
+
+	// The left edge of the original ends up on top, its top-left corner on the right
+	out, _ := NewGoResizer().Resize(in, Imgmeta{Original: "test.png", Width: 100, Height: 200})
+	dst, _, _ := image.Decode(bytes.NewReader(out))
+	r, g, _, _ := dst.At(dst.Bounds().Dx()-1, 0).RGBA()
+	if r>>8 > 16 || g>>8 > 16 {
+		t.Errorf("expected the top-left corner of the original on the top-right, got color: %v", dst.At(dst.Bounds().Dx()-1, 0))
+	}
+
+	// Metadata carried over must not rotate the image again
+	out, _ = NewGoResizer().Resize(in, Imgmeta{Original: "test.png", Width: 100, Height: 100, Strip: false})
+	if e, a := 1, exifOrientation(readMetadata(out).exif); e != a {
+		t.Errorf("expected orientation: %v, got orientation: %v", e, a)
+	}
+}
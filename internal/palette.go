@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+var ErrInvalidColorCount = errors.New("count must be an integer between 1 and 16")
+
+const (
+	// DefaultColorCount is the size of palettes when none is asked for
+	DefaultColorCount = 5
+	maxColorCount     = 16
+	// paletteSize bounds the sample palettes are computed from
+	paletteSize = 100
+	// paletteIterations bounds the rounds of k-means, which usually settles well before
+	paletteIterations = 20
+)
+
+// PaletteJob asks the workers for the palette of an original
+type PaletteJob struct {
+	Original string `json:"original"`
+	Count    int    `json:"count"`
+}
+
+// NewPaletteJob parses the palette details out of the query string of a request
+func NewPaletteJob(filename string, query url.Values) (PaletteJob, error) {
+	job := PaletteJob{Original: filename, Count: DefaultColorCount}
+	if c := query.Get("count"); c != "" {
+		count, err := strconv.Atoi(c)
+		if err != nil || count < 1 || count > maxColorCount {
+			return job, ErrInvalidColorCount
+		}
+		job.Count = count
+	}
+	return job, nil
+}
+
+// Key identifies the palette on the ack bus, apart from derivative names
+func (j PaletteJob) Key() string {
+	return fmt.Sprintf("colors:%d:%s", j.Count, j.Original)
+}
+
+// Palette is the main colors of an original, formatted as RRGGBB like the color parameters
+type Palette struct {
+	Dominant string         `json:"dominant,omitempty"` // empty for fully transparent images
+	Colors   []PaletteColor `json:"colors"`             // from the most to the least common
+}
+
+type PaletteColor struct {
+	Color string  `json:"color"`
+	Share float64 `json:"share"` // of the opaque pixels, 0 to 1
+}
+
+// NewPalette clusters the sRGB colors of an original with k-means, ignoring mostly transparent pixels;
+// images with fewer distinct colors than asked for get a shorter palette
+func NewPalette(data []byte, count int) (Palette, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Palette{}, decodeError{err}
+	}
+	rgba := toRGBA(src)
+	toSRGB(rgba, readMetadata(data).icc)
+	sample := placeholderSample(rgba, paletteSize)
+
+	var pixels [][3]float64
+	b := sample.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			p := sample.Pix[sample.PixOffset(x, y):]
+			if p[3] < 128 {
+				continue
+			}
+			a := float64(p[3]) / 255
+			pixels = append(pixels, [3]float64{float64(p[0]) / a, float64(p[1]) / a, float64(p[2]) / a})
+		}
+	}
+
+	palette := Palette{Colors: []PaletteColor{}}
+	if len(pixels) == 0 {
+		return palette, nil
+	}
+
+	centers, sizes := kmeans(pixels, count)
+	order := make([]int, len(centers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return sizes[order[i]] > sizes[order[j]] })
+
+	for _, i := range order {
+		if sizes[i] == 0 {
+			continue
+		}
+		c := color.NRGBA{R: paletteChannel(centers[i][0]), G: paletteChannel(centers[i][1]), B: paletteChannel(centers[i][2]), A: 255}
+		share := math.Round(float64(sizes[i])/float64(len(pixels))*1000) / 1000
+		palette.Colors = append(palette.Colors, PaletteColor{Color: colorHex(c), Share: share})
+	}
+	palette.Dominant = palette.Colors[0].Color
+	return palette, nil
+}
+
+// kmeans clusters pixels around count centers, seeded deterministically with the average color
+// then the pixels farthest from the centers so far, so a given original always gets the same palette
+func kmeans(pixels [][3]float64, count int) (centers [][3]float64, sizes []int) {
+	var mean [3]float64
+	for _, p := range pixels {
+		for c := range mean {
+			mean[c] += p[c] / float64(len(pixels))
+		}
+	}
+	centers = append(centers, mean)
+
+	nearest := make([]float64, len(pixels))
+	for i, p := range pixels {
+		nearest[i] = colorDistance(p, mean)
+	}
+	for len(centers) < count {
+		farthest := 0
+		for i := range pixels {
+			if nearest[i] > nearest[farthest] {
+				farthest = i
+			}
+		}
+		// Fewer distinct colors than asked for
+		if nearest[farthest] == 0 {
+			break
+		}
+		centers = append(centers, pixels[farthest])
+		for i, p := range pixels {
+			nearest[i] = math.Min(nearest[i], colorDistance(p, pixels[farthest]))
+		}
+	}
+
+	assignments := make([]int, len(pixels))
+	for iteration := 0; iteration < paletteIterations; iteration++ {
+		changed := iteration == 0
+		for i, p := range pixels {
+			closest := 0
+			for j := range centers {
+				if colorDistance(p, centers[j]) < colorDistance(p, centers[closest]) {
+					closest = j
+				}
+			}
+			if assignments[i] != closest {
+				assignments[i] = closest
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		sums := make([][3]float64, len(centers))
+		sizes = make([]int, len(centers))
+		for i, p := range pixels {
+			for c := range p {
+				sums[assignments[i]][c] += p[c]
+			}
+			sizes[assignments[i]]++
+		}
+		for j := range centers {
+			if sizes[j] > 0 {
+				for c := range sums[j] {
+					centers[j][c] = sums[j][c] / float64(sizes[j])
+				}
+			}
+		}
+	}
+	return centers, sizes
+}
+
+func colorDistance(a, b [3]float64) float64 {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dr*dr + dg*dg + db*db
+}
+
+func paletteChannel(v float64) uint8 {
+	return uint8(math.Round(math.Max(0, math.Min(255, v))))
+}
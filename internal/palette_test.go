@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/url"
+	"testing"
+)
+
+func Test_NewPalette(t *testing.T) {
+	// Three quarters red, a quarter blue, and a transparent stripe that doesn't count
+	src := image.NewNRGBA(image.Rect(0, 0, 80, 50))
+	draw.Draw(src, image.Rect(0, 0, 60, 40), image.NewUniform(color.NRGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(60, 0, 80, 40), image.NewUniform(color.NRGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	var in bytes.Buffer
+	png.Encode(&in, src)
+
+	palette, err := NewPalette(in.Bytes(), 5)
+	if err != nil {
+		t.Fatalf("failed to compute palette: %s", err)
+	}
+	if palette.Dominant != "ff0000" {
+		t.Errorf("expected dominant: %v, got dominant: %v", "ff0000", palette.Dominant)
+	}
+	// Scaling blends the two colors along their border
+	if len(palette.Colors) < 2 || palette.Colors[0].Share < 0.6 || palette.Colors[0].Share > 0.8 {
+		t.Fatalf("expected a red share around: %v, got palette: %v", 0.75, palette.Colors)
+	}
+	var blue bool
+	for _, c := range palette.Colors {
+		blue = blue || c.Color == "0000ff"
+	}
+	if !blue {
+		t.Errorf("expected color: %v in palette, got palette: %v", "0000ff", palette.Colors)
+	}
+
+	// Same input, same palette
+	again, _ := NewPalette(in.Bytes(), 5)
+	if fmt.Sprint(again) != fmt.Sprint(palette) {
+		t.Errorf("expected palette: %v, got palette: %v", palette, again)
+	}
+
+	var clear bytes.Buffer
+	png.Encode(&clear, image.NewNRGBA(image.Rect(0, 0, 10, 10)))
+	if palette, _ = NewPalette(clear.Bytes(), 5); palette.Dominant != "" || len(palette.Colors) != 0 {
+		t.Errorf("expected an empty palette, got palette: %v", palette)
+	}
+}
+
+func Test_NewPaletteJob(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+		err      error
+	}{
+		{"", "colors:5:landscape.jpg", nil},
+		{"count=1", "colors:1:landscape.jpg", nil},
+		{"count=16", "colors:16:landscape.jpg", nil},
+		{"count=0", "", ErrInvalidColorCount},
+		{"count=17", "", ErrInvalidColorCount},
+		{"count=many", "", ErrInvalidColorCount},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		job, err := NewPaletteJob("landscape.jpg", query)
+		if err != tt.err {
+			t.Errorf("%s: expected err: %v, got err: %v", tt.query, tt.err, err)
+			continue
+		}
+		if err == nil && job.Key() != tt.expected {
+			t.Errorf("%s: expected key: %v, got key: %v", tt.query, tt.expected, job.Key())
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+)
+
+var ErrInvalidPlaceholderType = errors.New("type must be blurhash, thumbhash or lqip")
+
+// PlaceholderType is the encoding of the low quality preview of an original
+type PlaceholderType string
+
+const (
+	PlaceholderBlurhash  PlaceholderType = "blurhash"  // https://blurha.sh
+	PlaceholderThumbhash PlaceholderType = "thumbhash" // https://evanw.github.io/thumbhash, base64 encoded
+	PlaceholderLQIP      PlaceholderType = "lqip"      // tiny image as a base64 data URI
+)
+
+func ParsePlaceholderType(s string) (PlaceholderType, error) {
+	switch t := PlaceholderType(s); t {
+	case PlaceholderBlurhash, PlaceholderThumbhash, PlaceholderLQIP:
+		return t, nil
+	}
+	return "", ErrInvalidPlaceholderType
+}
+
+const (
+	// placeholderSize bounds the sample the hashes are computed from; thumbhash requires at most 100
+	placeholderSize = 100
+	// lqipSize bounds the dimensions of inline previews
+	lqipSize = 32
+)
+
+// Placeholder is painted by clients while the derivatives of an original are produced
+type Placeholder struct {
+	Type   PlaceholderType `json:"type"`
+	Value  string          `json:"value"`
+	Width  int             `json:"width"` // of the oriented original, for the aspect ratio of decoded hashes
+	Height int             `json:"height"`
+}
+
+// NewPlaceholder computes the placeholder of an original, once turned upright and converted to sRGB
+func NewPlaceholder(data []byte, placeholderType PlaceholderType) (Placeholder, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Placeholder{}, decodeError{err}
+	}
+	md := readMetadata(data)
+	rgba := toRGBA(src)
+	toSRGB(rgba, md.icc)
+	rgba = orient(rgba, Imgmeta{}, exifOrientation(md.exif))
+	size := rgba.Bounds().Size()
+	p := Placeholder{Type: placeholderType, Width: size.X, Height: size.Y}
+
+	switch placeholderType {
+	case PlaceholderBlurhash:
+		sample := placeholderSample(rgba, placeholderSize)
+		flatten(sample, DefaultBackground)
+		p.Value = blurhash(sample)
+	case PlaceholderThumbhash:
+		p.Value = base64.StdEncoding.EncodeToString(thumbhash(placeholderSample(rgba, placeholderSize)))
+	case PlaceholderLQIP:
+		p.Value, err = lqip(placeholderSample(rgba, lqipSize))
+	default:
+		err = ErrInvalidPlaceholderType
+	}
+	return p, err
+}
+
+// placeholderSample shrinks img to fit inside a max x max box, keeping its aspect ratio
+func placeholderSample(img *image.RGBA, max int) *image.RGBA {
+	size := img.Bounds().Size()
+	if size.X <= max && size.Y <= max {
+		return scale(img, size.X, size.Y)
+	}
+	sample := fitInside(size.X, size.Y, max, max)
+	return scale(img, sample.X, sample.Y)
+}
+
+// lqip encodes img as a data URI, in PNG when it has transparency
+func lqip(img *image.RGBA) (string, error) {
+	var buf bytes.Buffer
+	mime := "image/jpeg"
+	if img.Opaque() {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 50}); err != nil {
+			return "", err
+		}
+	} else {
+		mime = "image/png"
+		if err := png.Encode(&buf, img); err != nil {
+			return "", err
+		}
+	}
+	return "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurhash encodes an opaque image with 4 components along its longest side and 3 along the other
+func blurhash(img *image.RGBA) string {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	nx, ny := 4, 3
+	if h > w {
+		nx, ny = 3, 4
+	}
+
+	factors := make([][3]float64, 0, nx*ny)
+	for j := 0; j < ny; j++ {
+		for i := 0; i < nx; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y):]
+					for c := 0; c < 3; c++ {
+						f[c] += basis * srgbToLinear(p[c])
+					}
+				}
+			}
+			for c := range f {
+				f[c] *= normalisation / float64(w*h)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(base83((nx-1)+(ny-1)*9, 1))
+
+	maximum := 1.0
+	if len(factors) > 1 {
+		var actual float64
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actual = math.Max(actual, math.Abs(v))
+			}
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		hash.WriteString(base83(quantised, 1))
+	} else {
+		hash.WriteString(base83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(base83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+	for _, f := range factors[1:] {
+		var ac int
+		for _, v := range f {
+			q := int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+			ac = ac*19 + q
+		}
+		hash.WriteString(base83(ac, 2))
+	}
+	return hash.String()
+}
+
+func base83(v, length int) string {
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = base83Chars[v%83]
+		v /= 83
+	}
+	return string(out)
+}
+
+func srgbToLinear(v uint8) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(v float64) int {
+	c := math.Max(0, math.Min(1, v))
+	if c <= 0.0031308 {
+		return int(c*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(c, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// thumbhash encodes an image of at most 100x100 pixels, following the reference implementation
+func thumbhash(img *image.RGBA) []byte {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	n := w * h
+
+	// Average color, which transparent pixels are blended with
+	var avgR, avgG, avgB, avgA float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y):]
+			avgR += float64(p[0]) / 255
+			avgG += float64(p[1]) / 255
+			avgB += float64(p[2]) / 255
+			avgA += float64(p[3]) / 255
+		}
+	}
+	if avgA > 0 {
+		avgR, avgG, avgB = avgR/avgA, avgG/avgA, avgB/avgA
+	}
+
+	hasAlpha := avgA < float64(n)
+	limit := 7.0
+	if hasAlpha {
+		limit = 5
+	}
+	longest := float64(maxInt(w, h))
+	lx := maxInt(1, int(jsRound(limit*float64(w)/longest)))
+	ly := maxInt(1, int(jsRound(limit*float64(h)/longest)))
+
+	// Luminance, yellow-blue, red-green and alpha channels
+	l, p, q, a := make([]float64, n), make([]float64, n), make([]float64, n), make([]float64, n)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px := img.Pix[img.PixOffset(b.Min.X+x, b.Min.Y+y):]
+			alpha := float64(px[3]) / 255
+			r := avgR*(1-alpha) + float64(px[0])/255
+			g := avgG*(1-alpha) + float64(px[1])/255
+			bl := avgB*(1-alpha) + float64(px[2])/255
+			i := x + y*w
+			l[i] = (r + g + bl) / 3
+			p[i] = (r+g)/2 - bl
+			q[i] = r - g
+			a[i] = alpha
+		}
+	}
+
+	encodeChannel := func(channel []float64, nx, ny int) (dc float64, ac []float64, scale float64) {
+		fx := make([]float64, w)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				for x := 0; x < w; x++ {
+					fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + 0.5))
+				}
+				var f float64
+				for y := 0; y < h; y++ {
+					fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + 0.5))
+					for x := 0; x < w; x++ {
+						f += channel[x+y*w] * fx[x] * fy
+					}
+				}
+				f /= float64(n)
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = math.Max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = 0.5 + 0.5/scale*ac[i]
+			}
+		}
+		return dc, ac, scale
+	}
+	lDC, lAC, lScale := encodeChannel(l, maxInt(3, lx), maxInt(3, ly))
+	pDC, pAC, pScale := encodeChannel(p, 3, 3)
+	qDC, qAC, qScale := encodeChannel(q, 3, 3)
+
+	isLandscape := w > h
+	header24 := int(jsRound(63*lDC)) | int(jsRound(31.5+31.5*pDC))<<6 | int(jsRound(31.5+31.5*qDC))<<12 |
+		int(jsRound(31*lScale))<<18
+	if hasAlpha {
+		header24 |= 1 << 23
+	}
+	header16 := ly
+	if !isLandscape {
+		header16 = lx
+	}
+	header16 |= int(jsRound(63*pScale))<<3 | int(jsRound(63*qScale))<<9
+	if isLandscape {
+		header16 |= 1 << 15
+	}
+	hash := []byte{byte(header24), byte(header24 >> 8), byte(header24 >> 16), byte(header16), byte(header16 >> 8)}
+
+	acs := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		aDC, aAC, aScale := encodeChannel(a, 5, 5)
+		hash = append(hash, byte(int(jsRound(15*aDC))|int(jsRound(15*aScale))<<4))
+		acs = append(acs, aAC)
+	}
+	start := len(hash)
+	index := 0
+	for _, ac := range acs {
+		for _, f := range ac {
+			if start+index>>1 == len(hash) {
+				hash = append(hash, 0)
+			}
+			hash[start+index>>1] |= byte(int(jsRound(15*f)) << uint((index&1)<<2))
+			index++
+		}
+	}
+	return hash
+}
+
+// jsRound rounds halves up like the reference implementation, where math.Round rounds them away from zero
+func jsRound(v float64) float64 {
+	return math.Floor(v + 0.5)
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func Test_NewPlaceholder(t *testing.T) {
+	var black, clear bytes.Buffer
+	src := image.NewNRGBA(image.Rect(0, 0, 60, 40))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	png.Encode(&black, src)
+	png.Encode(&clear, image.NewNRGBA(image.Rect(0, 0, 40, 60)))
+
+	tests := []struct {
+		data     []byte
+		typ      PlaceholderType
+		expected string
+	}{
+		{black.Bytes(), PlaceholderBlurhash, "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{black.Bytes(), PlaceholderLQIP, "data:image/jpeg;base64,"},
+		{clear.Bytes(), PlaceholderLQIP, "data:image/png;base64,"},
+	}
+
+	for _, tt := range tests {
+		p, err := NewPlaceholder(tt.data, tt.typ)
+		if err != nil {
+			t.Fatalf("failed to compute placeholder: %s", err)
+		}
+		if !strings.HasPrefix(p.Value, tt.expected) {
+			t.Errorf("expected %s: %v, got %s: %v", tt.typ, tt.expected, tt.typ, p.Value)
+		}
+		if tt.typ == PlaceholderLQIP {
+			data, _ := base64.StdEncoding.DecodeString(strings.SplitN(p.Value, ",", 2)[1])
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil || cfg.Width > lqipSize || cfg.Height > lqipSize {
+				t.Errorf("expected preview within: %dx%d, got preview: %dx%d (%v)", lqipSize, lqipSize, cfg.Width, cfg.Height, err)
+			}
+		}
+	}
+
+	// Thumbhashes tell the orientation and transparency in their headers
+	for _, tt := range []struct {
+		data      []byte
+		landscape bool
+		alpha     bool
+	}{{black.Bytes(), true, false}, {clear.Bytes(), false, true}} {
+		p, err := NewPlaceholder(tt.data, PlaceholderThumbhash)
+		if err != nil {
+			t.Fatalf("failed to compute placeholder: %s", err)
+		}
+		hash, err := base64.StdEncoding.DecodeString(p.Value)
+		if err != nil || len(hash) < 5 {
+			t.Fatalf("failed to decode thumbhash: %v", p.Value)
+		}
+		if landscape := hash[4]&0x80 != 0; landscape != tt.landscape {
+			t.Errorf("expected landscape: %v, got landscape: %v", tt.landscape, landscape)
+		}
+		if alpha := hash[2]&0x80 != 0; alpha != tt.alpha {
+			t.Errorf("expected alpha: %v, got alpha: %v", tt.alpha, alpha)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"errors"
+	"image"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// EncodingPolicy holds the server side defaults and limits of the encoder options
+type EncodingPolicy struct {
+	Quality     int // default quality
+	MinQuality  int
+	MaxQuality  int
+	Progressive bool // default for progressive
+	Strip       bool // default for strip
+}
+
+// DefaultEncodingPolicy suits web delivery: q75 progressive JPEGs without metadata
+var DefaultEncodingPolicy = EncodingPolicy{
+	Quality:     75,
+	MinQuality:  1,
+	MaxQuality:  100,
+	Progressive: true,
+	Strip:       true,
+}
+
+// Apply completes a derivative with the encoder options its request left out and clamps its quality
+// to the allowed range; options meaningless for its format are dropped, so they don't make up distinct
+// derivatives. Originals are served as they are.
+func (p EncodingPolicy) Apply(img Imgmeta, query url.Values) Imgmeta {
+	if img.IsOriginal {
+		return img
+	}
+
+	if img.Quality == 0 {
+		img.Quality = p.Quality
+	}
+	img.Quality = clampInt(img.Quality, p.MinQuality, p.MaxQuality)
+	if query.Get("progressive") == "" {
+		img.Progressive = p.Progressive
+	}
+	if query.Get("strip") == "" {
+		img.Strip = p.Strip
+	}
+
+	// Only JPEG is lossy and encoded progressively, WebP derivatives are lossless
+	if img.OutputFormat() != FormatJPEG {
+		img.Quality = 0
+		img.Progressive = false
+	}
+	return img
+}
+
+var (
+	ErrTooLarge       = errors.New("requested size exceeds the allowed dimensions")
+	ErrUpscale        = errors.New("requested size exceeds the size of the original")
+	ErrInvalidUpscale = errors.New("upscale policy must be one of allow, reject, clamp")
+)
+
+// Upscale tells what happens to requests that would enlarge the original
+type Upscale string
+
+const (
+	UpscaleAllow  Upscale = "allow"
+	UpscaleReject Upscale = "reject" // answer with a 400
+	UpscaleClamp  Upscale = "clamp"  // shrink the requested size down to the original's
+)
+
+func ParseUpscale(s string) (Upscale, error) {
+	switch upscale := Upscale(s); upscale {
+	case UpscaleAllow, UpscaleReject, UpscaleClamp:
+		return upscale, nil
+	}
+	return "", ErrInvalidUpscale
+}
+
+// SizePolicy bounds the dimensions of derivatives, so that requests can't make workers allocate
+// unbounded amounts of memory; zero limits are unbounded.
+type SizePolicy struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int // width x height
+	Upscale   Upscale
+}
+
+var DefaultSizePolicy = SizePolicy{
+	MaxWidth:  4096,
+	MaxHeight: 4096,
+	MaxPixels: 4096 * 4096,
+	Upscale:   UpscaleAllow,
+}
+
+// NeedsOriginalSize tells whether checking img requires the size of its original; without a box to
+// resize to, the derivative is as large as the original plus its border
+func (p SizePolicy) NeedsOriginalSize(img Imgmeta) bool {
+	return !img.IsOriginal &&
+		(img.Width == 0 && img.Height == 0 || p.Upscale != UpscaleAllow || img.Fit == FitOutside)
+}
+
+// Apply checks a derivative against the limits, clamping it when the upscale policy says so;
+// the size of the original, when known, also bounds what the fit mode produces out of the box.
+func (p SizePolicy) Apply(img Imgmeta, origW, origH int) (Imgmeta, error) {
+	if err := p.check(img, origW, origH); err != ErrUpscale || p.Upscale != UpscaleClamp {
+		return img, err
+	}
+
+	// Shrink the box by the factor the kept region of the original would have been enlarged by
+	l := newLayout(origW, origH, img)
+	fx := float64(l.scaled.X) / float64(l.crop.Dx())
+	fy := float64(l.scaled.Y) / float64(l.crop.Dy())
+	if img.Fit != FitFill {
+		fx = math.Max(fx, fy)
+		fy = fx
+	}
+	img.Width = maxInt(1, int(math.Round(float64(img.Width)/math.Max(fx, 1))))
+	img.Height = maxInt(1, int(math.Round(float64(img.Height)/math.Max(fy, 1))))
+	return img, nil
+}
+
+// Validate checks a derivative against the limits without clamping it; it is meant for workers,
+// which must produce what was asked for or nothing. Clamped sizes are let through, as rounding
+// may leave them a pixel above the original.
+func (p SizePolicy) Validate(img Imgmeta, origW, origH int) error {
+	if err := p.check(img, origW, origH); err != ErrUpscale || p.Upscale != UpscaleClamp {
+		return err
+	}
+	return nil
+}
+
+func (p SizePolicy) check(img Imgmeta, origW, origH int) error {
+	if isUntransformed(img) {
+		return nil
+	}
+	if (img.Width != 0 || img.Height != 0) && !p.fits(image.Pt(img.Width, img.Height)) {
+		return ErrTooLarge
+	}
+	if origW < 1 || origH < 1 {
+		// Of the final canvas, only the border is known then
+		if !p.fits(image.Pt(2*img.Pad, 2*img.Pad)) {
+			return ErrTooLarge
+		}
+		return nil
+	}
+
+	l := newLayout(origW, origH, img)
+	if !p.fits(l.scaled) || !p.fits(l.canvas) {
+		return ErrTooLarge
+	}
+	if p.Upscale != UpscaleAllow && (l.scaled.X > l.crop.Dx() || l.scaled.Y > l.crop.Dy()) {
+		return ErrUpscale
+	}
+	return nil
+}
+
+// isUntransformed tells whether img is its original as is; the is_original field comes from the
+// queue as it was sent, the name derived from the transformations doesn't
+func isUntransformed(img Imgmeta) bool {
+	img.IsOriginal = false
+	return img.Name() == img.Original
+}
+
+func (p SizePolicy) fits(size image.Point) bool {
+	if p.MaxWidth > 0 && size.X > p.MaxWidth || p.MaxHeight > 0 && size.Y > p.MaxHeight {
+		return false
+	}
+	// Comparing each dimension first keeps the product from overflowing
+	return p.MaxPixels == 0 || size.X <= p.MaxPixels && size.Y <= p.MaxPixels && size.X*size.Y <= p.MaxPixels
+}
+
+var (
+	ErrSizeNotAllowed  = errors.New("requested size is not among the allowed sizes")
+	ErrInvalidSizeList = errors.New("sizes must be a comma separated list of 123x123, 123x or x123")
+	ErrInvalidSizeMode = errors.New("size mode must be one of snap, strict")
+)
+
+// SizeMode tells what happens to requested sizes that aren't in the allow-list
+type SizeMode string
+
+const (
+	SizeModeSnap   SizeMode = "snap"   // round up to the nearest allowed size
+	SizeModeStrict SizeMode = "strict" // answer with a 400
+)
+
+func ParseSizeMode(s string) (SizeMode, error) {
+	switch mode := SizeMode(s); mode {
+	case SizeModeSnap, SizeModeStrict:
+		return mode, nil
+	}
+	return "", ErrInvalidSizeMode
+}
+
+// SizeBuckets is an allow-list of sizes, which keeps clients from filling the disk with near-duplicate
+// derivatives. Sizes use the syntax of the size parameter: a width bucket such as 320x only stands for
+// width-only requests, a 300x200 box for requests with both dimensions. An empty list allows any size.
+type SizeBuckets struct {
+	Sizes []image.Point // a zero dimension is left out
+	Mode  SizeMode
+}
+
+// ParseSizeBuckets parses a comma separated list of sizes
+func ParseSizeBuckets(sizes string, mode SizeMode) (SizeBuckets, error) {
+	buckets := SizeBuckets{Mode: mode}
+	for _, size := range strings.Split(sizes, ",") {
+		size = strings.TrimSpace(size)
+		if size == "" {
+			continue
+		}
+		match := resRegexp.FindStringSubmatch(size)
+		if match == nil || match[1] == "" && match[2] == "" {
+			return SizeBuckets{}, ErrInvalidSizeList
+		}
+		var bucket image.Point
+		for i, dim := range []*int{&bucket.X, &bucket.Y} {
+			if match[i+1] == "" {
+				continue
+			}
+			v, err := strconv.Atoi(match[i+1])
+			if err != nil || v < 1 || v > maxDimension {
+				return SizeBuckets{}, ErrInvalidSizeList
+			}
+			*dim = v
+		}
+		buckets.Sizes = append(buckets.Sizes, bucket)
+	}
+	return buckets, nil
+}
+
+// Apply matches the requested size of a derivative against the allow-list. In snap mode, it is
+// rounded up to the smallest allowed size of the same kind covering it; sizes larger than every
+// bucket are refused either way, as making them up would defeat the list.
+func (b SizeBuckets) Apply(img Imgmeta) (Imgmeta, error) {
+	if len(b.Sizes) == 0 || img.IsOriginal || img.Width == 0 && img.Height == 0 {
+		return img, nil
+	}
+
+	requested := image.Pt(img.Width, img.Height)
+	best, found := image.Point{}, false
+	for _, size := range b.Sizes {
+		if size == requested {
+			return img, nil
+		}
+		if b.Mode != SizeModeSnap || !covers(size, requested) {
+			continue
+		}
+		if !found || size.X+size.Y < best.X+best.Y {
+			best, found = size, true
+		}
+	}
+	if !found {
+		return img, ErrSizeNotAllowed
+	}
+	img.Width, img.Height = best.X, best.Y
+	return img, nil
+}
+
+// covers tells whether bucket has the same dimensions set as size, each at least as large
+func covers(bucket, size image.Point) bool {
+	return (bucket.X == 0) == (size.X == 0) && (bucket.Y == 0) == (size.Y == 0) &&
+		bucket.X >= size.X && bucket.Y >= size.Y
+}
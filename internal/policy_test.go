@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+func Test_EncodingPolicy_Apply(t *testing.T) {
+	policy := EncodingPolicy{Quality: 75, MinQuality: 30, MaxQuality: 90, Progressive: true, Strip: true}
+	tests := []struct {
+		filename string
+		query    string
+		name     string
+	}{
+		{"landscape.jpg", "", "landscape.jpg"},
+		{"landscape.jpg", "size=300x200", "landscape_300x200_q75_progressive_strip.jpg"},
+		{"landscape.jpg", "size=300x200&q=100", "landscape_300x200_q90_progressive_strip.jpg"},
+		{"landscape.jpg", "size=300x200&q=10&progressive=false", "landscape_300x200_q30_strip.jpg"},
+		{"landscape.jpg", "size=300x200&strip=false", "landscape_300x200_q75_progressive.jpg"},
+		{"landscape.jpg", "size=300x200&format=webp", "landscape_300x200_strip.jpg.webp"},
+		{"logo.png", "size=300x200&q=50", "logo_300x200_strip.png"},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		img, err := NewImageFromRequest(tt.filename, query)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.query, err)
+			continue
+		}
+		if name := policy.Apply(img, query).Name(); name != tt.name {
+			t.Errorf("%q: expected name: %v, got name: %v", tt.query, tt.name, name)
+		}
+	}
+}
+
+func Test_SizePolicy_Apply(t *testing.T) {
+	tests := []struct {
+		upscale Upscale
+		img     Imgmeta
+		width   int
+		height  int
+		err     error
+	}{
+		{UpscaleAllow, Imgmeta{Width: 300, Height: 200}, 300, 200, nil},
+		{UpscaleAllow, Imgmeta{Width: 5000, Height: 200}, 0, 0, ErrTooLarge},
+		{UpscaleAllow, Imgmeta{Width: 1000, Height: 1000}, 0, 0, ErrTooLarge},
+		{UpscaleAllow, Imgmeta{Width: 900, Height: 100, Fit: FitOutside}, 0, 0, ErrTooLarge},
+		{UpscaleAllow, Imgmeta{Width: 600, Height: 600, Fit: FitContain}, 600, 600, nil},
+		{UpscaleReject, Imgmeta{Width: 300, Height: 200}, 300, 200, nil},
+		{UpscaleReject, Imgmeta{Width: 800, Height: 200}, 800, 200, nil},
+		{UpscaleReject, Imgmeta{Width: 800, Height: 400}, 0, 0, ErrUpscale},
+		{UpscaleClamp, Imgmeta{Width: 800, Height: 400}, 400, 200, nil},
+		{UpscaleClamp, Imgmeta{Width: 600, Height: 600, Fit: FitCover}, 200, 200, nil},
+		{UpscaleClamp, Imgmeta{Width: 800, Height: 100, Fit: FitFill}, 400, 100, nil},
+		{UpscaleAllow, Imgmeta{IsOriginal: true}, 0, 0, nil},
+		{UpscaleAllow, Imgmeta{IsOriginal: true, Width: 60000, Height: 60000}, 0, 0, ErrTooLarge},
+		{UpscaleAllow, Imgmeta{Pad: 10}, 0, 0, nil},
+		{UpscaleAllow, Imgmeta{Pad: 1000}, 0, 0, ErrTooLarge},
+	}
+
+	for _, tt := range tests {
+		policy := SizePolicy{MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 600 * 600, Upscale: tt.upscale}
+		tt.img.Original = "landscape.jpg"
+		img, err := policy.Apply(tt.img, 400, 200)
+		if err != tt.err {
+			t.Errorf("%v %+v: expected error: %v, got error: %v", tt.upscale, tt.img, tt.err, err)
+			continue
+		}
+		if err == nil && (img.Width != tt.width || img.Height != tt.height) {
+			t.Errorf("%v %+v: expected size: %vx%v, got size: %vx%v", tt.upscale, tt.img, tt.width, tt.height, img.Width, img.Height)
+		}
+	}
+}
+
+func Test_SizePolicy_Validate(t *testing.T) {
+	tests := []struct {
+		task   string
+		width  int
+		height int
+		err    error
+	}{
+		{`{"original":"landscape.jpg","is_original":true}`, 400, 200, nil},
+		{`{"original":"landscape.jpg","width":300,"height":200}`, 400, 200, nil},
+		{`{"original":"landscape.jpg","is_original":true,"width":60000,"height":60000}`, 400, 200, ErrTooLarge},
+		{`{"original":"landscape.jpg","is_original":true,"width":60000,"height":60000}`, 0, 0, ErrTooLarge},
+		{`{"original":"landscape.jpg","pad":1000000}`, 400, 200, ErrTooLarge},
+		{`{"original":"landscape.jpg","pad":1000000}`, 0, 0, ErrTooLarge},
+	}
+
+	for _, tt := range tests {
+		var img Imgmeta
+		if err := json.Unmarshal([]byte(tt.task), &img); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := DefaultSizePolicy.Validate(img, tt.width, tt.height); err != tt.err {
+			t.Errorf("%s: expected error: %v, got error: %v", tt.task, tt.err, err)
+		}
+	}
+}
+
+func Test_SizeBuckets_Apply(t *testing.T) {
+	tests := []struct {
+		mode  SizeMode
+		query string
+		name  string
+		err   error
+	}{
+		{SizeModeSnap, "", "landscape.jpg", nil},
+		{SizeModeSnap, "size=301x", "landscape_320x0.jpg", nil},
+		{SizeModeSnap, "size=320x", "landscape_320x0.jpg", nil},
+		{SizeModeSnap, "size=321x", "landscape_640x0.jpg", nil},
+		{SizeModeSnap, "size=1000x", "", ErrSizeNotAllowed},
+		{SizeModeSnap, "size=x100", "", ErrSizeNotAllowed},
+		{SizeModeSnap, "size=290x200", "landscape_300x300.jpg", nil},
+		{SizeModeSnap, "size=120x80", "landscape_150x100.jpg", nil},
+		{SizeModeStrict, "size=320x", "landscape_320x0.jpg", nil},
+		{SizeModeStrict, "size=301x", "", ErrSizeNotAllowed},
+	}
+
+	for _, tt := range tests {
+		buckets, err := ParseSizeBuckets("320x, 640x,150x100,300x300", tt.mode)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		query, _ := url.ParseQuery(tt.query)
+		img, err := NewImageFromRequest("landscape.jpg", query)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.query, err)
+			continue
+		}
+		img, err = buckets.Apply(img)
+		if err != tt.err {
+			t.Errorf("%q: expected error: %v, got error: %v", tt.query, tt.err, err)
+			continue
+		}
+		if err == nil && img.Name() != tt.name {
+			t.Errorf("%q: expected name: %v, got name: %v", tt.query, tt.name, img.Name())
+		}
+	}
+
+	if _, err := ParseSizeBuckets("320x,abc", SizeModeSnap); err != ErrInvalidSizeList {
+		t.Errorf("expected error: %v, got error: %v", ErrInvalidSizeList, err)
+	}
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+var ErrUnknownPreset = errors.New("unknown preset")
+
+// imageParams are the query parameters of derivatives, the only ones presets can set
+var imageParams = map[string]bool{
+	"size": true, "w": true, "h": true, "dpr": true, "fit": true, "gravity": true, "fp": true, "frame": true,
+	"rotate": true, "flip": true, "orient": true, "crop": true, "pad": true, "bg": true, "radius": true, "mask": true,
+	"grayscale": true, "sepia": true, "brightness": true, "contrast": true, "blur": true, "sharpen": true,
+	"wm": true, "wmpos": true, "wmopacity": true, "wmscale": true, "wmmargin": true,
+	"text": true, "font": true, "textsize": true, "textcolor": true, "textpos": true, "textshadow": true,
+	"format": true, "q": true, "progressive": true, "strip": true, "icc": true, "maxbytes": true,
+}
+
+// exclusiveParams are groups of parameters a request can only use one way of
+var exclusiveParams = [][]string{
+	{"size", "w", "h"},
+	{"gravity", "fp"},
+}
+
+// Presets are named bundles of query parameters, such as thumb, card or hero, which let ops change
+// derivative specs site-wide without touching client URLs. They are loaded from a JSON file like:
+//
+//	{"card": {"size": "600x400", "fit": "cover", "format": "jpeg", "q": 80}}
+//
+// and can be reloaded while the service runs.
+type Presets struct {
+	path        string
+	watermarks  Watermarks
+	fonts       Fonts
+	sizePolicy  SizePolicy
+	sizeBuckets SizeBuckets
+	mu          sync.RWMutex
+	presets     map[string]url.Values
+}
+
+// LoadPresets reads and validates the presets of a file; the watermarks and fonts they refer to must exist,
+// and the derivatives they describe must pass the policies of the service
+func LoadPresets(path string, watermarks Watermarks, fonts Fonts, sizePolicy SizePolicy, sizeBuckets SizeBuckets) (*Presets, error) {
+	p := &Presets{path: path, watermarks: watermarks, fonts: fonts, sizePolicy: sizePolicy, sizeBuckets: sizeBuckets}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload reads the presets file again; the current presets are kept when it is invalid
+func (p *Presets) Reload() error {
+	presets, err := p.read()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.presets = presets
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Presets) read() (map[string]url.Values, error) {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid presets file %s: %s", p.path, err))
+	}
+
+	presets := make(map[string]url.Values, len(raw))
+	for name, params := range raw {
+		query := url.Values{}
+		for key, value := range params {
+			if key == "preset" {
+				return nil, errors.New(fmt.Sprintf("invalid preset %s: presets can't refer to other presets", name))
+			}
+			if !imageParams[key] {
+				return nil, errors.New(fmt.Sprintf("invalid preset %s: unknown parameter %s", name, key))
+			}
+			switch v := value.(type) {
+			case string:
+				query.Set(key, v)
+			case float64:
+				query.Set(key, strconv.FormatFloat(v, 'f', -1, 64))
+			case bool:
+				query.Set(key, strconv.FormatBool(v))
+			default:
+				return nil, errors.New(fmt.Sprintf("invalid preset %s: %s must be a string, number or boolean", name, key))
+			}
+		}
+		// Any original will do, only the parameters are checked
+		img, err := NewImageFromRequest("preset.jpg", query)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid preset %s: %s", name, err))
+		}
+		if img.Watermark != nil && !p.watermarks.Has(img.Watermark.Name) {
+			return nil, errors.New(fmt.Sprintf("invalid preset %s: %s", name, ErrUnknownWatermark))
+		}
+		if img.Text != nil && !p.fonts.Has(img.Text.Font) {
+			return nil, errors.New(fmt.Sprintf("invalid preset %s: %s", name, ErrUnknownFont))
+		}
+		if err := p.check(img); err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid preset %s: %s", name, err))
+		}
+		presets[name] = query
+	}
+	return presets, nil
+}
+
+// check runs the checks of the service that don't depend on the original, so that presets don't make up
+// requests that are always refused
+func (p *Presets) check(img Imgmeta) error {
+	if !img.IsOriginal && !img.OutputFormat().Encodable() {
+		return ErrUnsupportedFormat
+	}
+	if img.MaxBytes > 0 && !img.OutputFormat().Lossy() {
+		return ErrLosslessMaxBytes
+	}
+	img, err := p.sizeBuckets.Apply(img)
+	if err != nil {
+		return err
+	}
+	_, err = p.sizePolicy.Apply(img, 0, 0)
+	return err
+}
+
+// Expand replaces the preset parameter of a query with the parameters of the preset;
+// parameters of the query take precedence over the preset's.
+func (p *Presets) Expand(query url.Values) (url.Values, error) {
+	name := query.Get("preset")
+	if name == "" {
+		return query, nil
+	}
+	if p == nil {
+		return nil, ErrUnknownPreset
+	}
+
+	p.mu.RLock()
+	preset, ok := p.presets[name]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, ErrUnknownPreset
+	}
+
+	expanded := url.Values{}
+	for key, values := range preset {
+		expanded[key] = values
+	}
+	// Parameters that can't be combined are overridden as a whole
+	for _, group := range exclusiveParams {
+		for _, key := range group {
+			if query.Get(key) != "" {
+				for _, k := range group {
+					delete(expanded, k)
+				}
+				break
+			}
+		}
+	}
+	for key, values := range query {
+		if key != "preset" {
+			expanded[key] = values
+		}
+	}
+	return expanded, nil
+}
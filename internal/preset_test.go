@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func Test_Presets(t *testing.T) {
+	f, err := ioutil.TempFile("", "presets*.json")
+	if err != nil {
+		t.Fatalf("failed to create the presets file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	ioutil.WriteFile(f.Name(), []byte(`{"card": {"size": "600x400", "fit": "cover", "gravity": "north", "q": 80}, "banner": {"text": "NEW", "font": "go-bold"}}`), 0644)
+
+	buckets, err := ParseSizeBuckets("600x400,300x,9000x9000", SizeModeStrict)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	presets, err := LoadPresets(f.Name(), NewWatermarks(""), NewFonts(""), DefaultSizePolicy, buckets)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		query string
+		name  string
+		err   error
+	}{
+		{"", "landscape.jpg", nil},
+		{"preset=card", "landscape_600x400_cover_g-north_q80.jpg", nil},
+		{"preset=card&w=300", "landscape_300x0_q80.jpg", nil},
+		{"preset=card&fp=0.2,0.3", "landscape_600x400_cover_fp-0.2-0.3_q80.jpg", nil},
+		{"preset=hero", "", ErrUnknownPreset},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		query, err := presets.Expand(query)
+		if err != tt.err {
+			t.Errorf("%q: expected error: %v, got error: %v", tt.query, tt.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		img, err := NewImageFromRequest("landscape.jpg", query)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.query, err)
+			continue
+		}
+		if img.Name() != tt.name {
+			t.Errorf("%q: expected name: %v, got name: %v", tt.query, tt.name, img.Name())
+		}
+	}
+
+	// An invalid file leaves the current presets in place
+	for _, invalid := range []string{
+		`{"card": {"size": "600x400", "fit": "squash"}}`,
+		`{"card": {"size": "600x400", "qualty": 80}}`,
+		`{"card": {"size": "600x400", "preset": "hero"}}`,
+		`{"card": {"size": "600x400", "wm": "missing.png"}}`,
+		`{"card": {"size": "600x400", "text": "NEW", "font": "missing.ttf"}}`,
+		`{"card": {"size": "600x400", "format": "png", "maxbytes": 10000}}`,
+		`{"card": {"size": "9000x9000"}}`,
+		`{"card": {"size": "640x480"}}`,
+	} {
+		ioutil.WriteFile(f.Name(), []byte(invalid), 0644)
+		if err := presets.Reload(); err == nil {
+			t.Errorf("%s: expected an error reloading invalid presets", invalid)
+		}
+	}
+	if _, err := presets.Expand(url.Values{"preset": {"card"}}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
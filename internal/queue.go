@@ -12,6 +12,8 @@ type ProcessingQueue interface {
 	Enqueue(img Imgmeta) error
 	PriorityEnqueue(img Imgmeta) error
 	Dequeue() (img Imgmeta, err error)
+	EnqueuePalette(job PaletteJob) error
+	DequeuePalette() (job PaletteJob, err error)
 }
 
 type RedisProcessingQueue struct {
@@ -50,6 +52,29 @@ func (r RedisProcessingQueue) Dequeue() (img Imgmeta, err error) {
 	return
 }
 
+// EnqueuePalette queues palettes apart from images, so they don't wait behind resizes
+func (r RedisProcessingQueue) EnqueuePalette(job PaletteJob) error {
+	serialized, err := json.Marshal(job)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to encode palette job to json: %s", err))
+	}
+	return r.client.LPush("queue:palettes", string(serialized)).Err()
+}
+
+func (r RedisProcessingQueue) DequeuePalette() (job PaletteJob, err error) {
+	data, err := r.client.LPop("queue:palettes").Result()
+	if err == redis.Nil {
+		return job, ErrNil
+	}
+	if err != nil {
+		return job, errors.New(fmt.Sprintf("failed to get palette job from Redis: %s", err))
+	}
+	if err = json.Unmarshal([]byte(data), &job); err != nil {
+		return job, errors.New(fmt.Sprintf("failed to decode palette job from json: %s", err))
+	}
+	return
+}
+
 func NewRedisQueue(client *redis.Client) ProcessingQueue {
 	return RedisProcessingQueue{client: client}
 }
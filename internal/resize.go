@@ -1,2 +1,406 @@
 package internal
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"sort"
+
+	"golang.org/x/image/font/opentype"
+)
+
+// Resizer turns the content of an original image into the derivative described by img.
+type Resizer interface {
+	Resize(in []byte, img Imgmeta) ([]byte, error)
+}
+
+var ErrBudgetExceeded = errors.New("image doesn't fit in the byte budget at any quality")
+
+// IsPermanent tells whether a resize failed for a reason retrying can't fix
+func IsPermanent(err error) bool {
+	if _, ok := err.(decodeError); ok {
+		return true
+	}
+	return err == ErrUnsupportedFormat || err == ErrBudgetExceeded || err == ErrTooLarge || err == ErrUpscale ||
+		err == ErrCropOutOfBounds || err == ErrUnknownWatermark ||
+		err == ErrUnknownFont || err == ErrFrameOutOfBounds
+}
+
+// ResizerOption configures the optional behaviours of a Resizer
+type ResizerOption func(o *resizerOptions)
+
+type resizerOptions struct {
+	watermarks Watermarks
+	fonts      Fonts
+}
+
+// WithResizerWatermarks sets the directory watermarks are read from
+func WithResizerWatermarks(watermarks Watermarks) ResizerOption {
+	return func(o *resizerOptions) {
+		o.watermarks = watermarks
+	}
+}
+
+// WithResizerFonts sets the directory fonts of text overlays are read from
+func WithResizerFonts(fonts Fonts) ResizerOption {
+	return func(o *resizerOptions) {
+		o.fonts = fonts
+	}
+}
+
+// resizers maps backend names, as passed on the command line, to their constructors;
+// backends that depend on cgo register themselves from files guarded by build tags.
+var resizers = map[string]func(opts ...ResizerOption) Resizer{
+	"go": NewGoResizer,
+}
+
+// NewResizer constructs the Resizer registered under the given backend name
+func NewResizer(backend string, opts ...ResizerOption) (Resizer, error) {
+	constructor, ok := resizers[backend]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown resizer backend %q, available: %v", backend, ResizerBackends()))
+	}
+	return constructor(opts...), nil
+}
+
+// ResizerBackends lists the names of the backends compiled into the binary
+func ResizerBackends() []string {
+	var names []string
+	for name := range resizers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renderer is implemented by resizers that draw derivatives apart from encoding them, so that byte budgets
+// are searched for by encoding the same pixels again rather than running the whole pipeline
+type renderer interface {
+	render(in []byte, img Imgmeta) (encoder, error)
+}
+
+// encoder encodes a rendered derivative with the encoder options of img
+type encoder func(img Imgmeta) ([]byte, error)
+
+// ResizeWithinBudget resizes an image whose encoded size must not exceed img.MaxBytes; for lossy formats
+// it searches for the highest quality, up to the requested one, that fits and returns it along the content.
+func ResizeWithinBudget(r Resizer, in []byte, img Imgmeta) ([]byte, int, error) {
+	encodeWith := func(img Imgmeta) ([]byte, error) {
+		return r.Resize(in, img)
+	}
+	if rd, ok := r.(renderer); ok && img.MaxBytes > 0 {
+		var err error
+		if encodeWith, err = rd.render(in, img); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	out, err := encodeWith(img)
+	if err != nil || img.MaxBytes == 0 || len(out) <= img.MaxBytes {
+		return out, img.Quality, err
+	}
+	if img.Quality == 0 {
+		// Lossless formats can't trade quality for size
+		return nil, 0, ErrBudgetExceeded
+	}
+
+	// Binary search the highest quality that fits, assuming size grows with quality
+	var best []byte
+	var bestQuality int
+	lo, hi := 1, img.Quality-1
+	for lo <= hi {
+		attempt := img
+		attempt.Quality = (lo + hi) / 2
+		out, err := encodeWith(attempt)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(out) <= img.MaxBytes {
+			best, bestQuality = out, attempt.Quality
+			lo = attempt.Quality + 1
+		} else {
+			hi = attempt.Quality - 1
+		}
+	}
+	if best == nil {
+		return nil, 0, ErrBudgetExceeded
+	}
+	return best, bestQuality, nil
+}
+
+// GoResizer is a pure-Go Resizer; it needs neither cgo nor libvips.
+type GoResizer struct {
+	watermarks Watermarks
+	fonts      Fonts
+}
+
+func NewGoResizer(opts ...ResizerOption) Resizer {
+	return newGoResizer(opts...)
+}
+
+func newGoResizer(opts ...ResizerOption) GoResizer {
+	var o resizerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return GoResizer{watermarks: o.watermarks, fonts: o.fonts}
+}
+
+func (g GoResizer) Resize(in []byte, img Imgmeta) ([]byte, error) {
+	encode, err := g.render(in, img)
+	if err != nil {
+		return nil, err
+	}
+	return encode(img)
+}
+
+// rendering is a derivative drawn by the Go backend, along what its encoding needs
+type rendering struct {
+	frames []*image.RGBA
+	anim   *gif.GIF // for animated derivatives only
+	md     metadata // carried over unless stripped
+}
+
+func (g GoResizer) render(in []byte, img Imgmeta) (encoder, error) {
+	var err error
+	var overlay *image.RGBA
+	if img.Watermark != nil {
+		if overlay, err = g.watermarks.load(img.Watermark.Name); err != nil {
+			return nil, err
+		}
+	}
+	var f *opentype.Font
+	if img.Text != nil {
+		if f, err = g.fonts.load(img.Text.Font); err != nil {
+			return nil, err
+		}
+	}
+
+	// Colors are converted to sRGB unless the profile is kept, which only JPEG and PNG can carry;
+	// the converted pixels must not be tagged with the original profile anymore
+	md := readMetadata(in)
+	convert := !img.KeepICC || !carriesMetadata(img.OutputFormat())
+	var converted bool
+
+	// Auto-orienting bakes the EXIF orientation into the pixels, so metadata carried over must say upright
+	orientation := exifOrientation(md.exif)
+	if !img.NoOrient {
+		md.exif = withExifOrientation(md.exif, 1)
+	}
+
+	// Every frame of an animation is laid out like its first one, so smart crops don't jump around
+	var frames []*image.RGBA
+	var l *layout
+	anim, err := decodeFrames(in, img, func(rgba *image.RGBA) error {
+		if convert && toSRGB(rgba, md.icc) {
+			converted = true
+		}
+
+		rgba = orient(rgba, img, orientation)
+		if img.Crop != nil {
+			r, err := img.Crop.Rect(rgba.Rect.Dx(), rgba.Rect.Dy())
+			if err != nil {
+				return err
+			}
+			rgba = toRGBA(rgba.SubImage(r))
+		}
+
+		if l == nil {
+			first := newLayout(rgba.Rect.Dx(), rgba.Rect.Dy(), img)
+			if img.Fit == FitCover && img.Gravity == GravitySmart {
+				first.crop = smartCrop(rgba, first.crop.Size())
+			}
+			l = &first
+		}
+		scaled := scale(rgba.SubImage(l.crop), l.scaled.X, l.scaled.Y)
+		scaled = img.Filters.apply(scaled)
+
+		dst := scaled
+		if l.canvas != l.scaled {
+			dst = image.NewRGBA(image.Rectangle{Max: l.canvas})
+			if img.Background != nil {
+				draw.Draw(dst, dst.Bounds(), image.NewUniform(*img.Background), image.Point{}, draw.Src)
+			}
+			draw.Draw(dst, scaled.Bounds().Add(l.offset), scaled, image.Point{}, draw.Src)
+		}
+
+		if overlay != nil {
+			img.Watermark.draw(dst, overlay)
+		}
+
+		if f != nil {
+			if err := img.Text.draw(dst, f); err != nil {
+				return err
+			}
+		}
+
+		if img.Radius != 0 || img.Mask != "" {
+			applyMask(dst, img.Mask, img.Radius)
+		}
+
+		// Formats without alpha would turn transparency black
+		if !img.OutputFormat().HasAlpha() && !dst.Opaque() {
+			flatten(dst, img.BackgroundOrDefault())
+		}
+		frames = append(frames, dst)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if converted {
+		md.icc = nil
+	}
+	return rendering{frames: frames, anim: anim, md: md}.encode, nil
+}
+
+// encode writes the rendered derivative with the encoder options of img
+func (r rendering) encode(img Imgmeta) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if r.anim != nil {
+		err = encodeAnimatedGIF(&buf, r.frames, r.anim)
+	} else {
+		err = encode(&buf, r.frames[0], img)
+	}
+	if err != nil {
+		if err == ErrUnsupportedFormat {
+			return nil, err
+		}
+		return nil, errors.New(fmt.Sprintf("failed to encode image: %s", err))
+	}
+
+	// Profiles left on the pixels, kept ones or ones that couldn't be converted, outlive stripping:
+	// the colors would be off without them
+	md := r.md
+	if img.Strip {
+		if md.icc == nil {
+			return buf.Bytes(), nil
+		}
+		md = metadata{icc: md.icc}
+	}
+	return writeMetadata(buf.Bytes(), img.OutputFormat(), md), nil
+}
+
+// layout describes how an original is mapped onto the output image
+type layout struct {
+	crop   image.Rectangle // region of the original that is kept
+	scaled image.Point     // size the kept region is scaled to
+	canvas image.Point     // size of the output image
+	offset image.Point     // position of the scaled region on the canvas
+}
+
+// newLayout maps a srcW x srcH original onto the box requested by img, according to its fit mode
+func newLayout(srcW, srcH int, img Imgmeta) layout {
+	l := layout{crop: image.Rect(0, 0, srcW, srcH)}
+	img = img.WithOriginalSize(srcW, srcH)
+
+	// Padding keeps to the requested box, the image is fit into what the border leaves of it
+	if img.Pad > 0 {
+		inner := img
+		inner.Pad = 0
+		if inner.Width != 0 || inner.Height != 0 {
+			inner.Width = maxInt(1, img.Width-2*img.Pad)
+			inner.Height = maxInt(1, img.Height-2*img.Pad)
+		}
+		l = newLayout(srcW, srcH, inner)
+		l.canvas = l.canvas.Add(image.Pt(2*img.Pad, 2*img.Pad))
+		l.offset = l.offset.Add(image.Pt(img.Pad, img.Pad))
+		return l
+	}
+
+	// No resizing asked for, only the other transformations
+	if img.Width == 0 && img.Height == 0 {
+		l.scaled = image.Pt(srcW, srcH)
+		l.canvas = l.scaled
+		return l
+	}
+
+	switch img.Fit {
+	case FitFill:
+		l.scaled = image.Pt(img.Width, img.Height)
+	case FitOutside:
+		l.scaled = fitOutside(srcW, srcH, img.Width, img.Height)
+	case FitCover:
+		l.crop = cropToAspect(srcW, srcH, img)
+		l.scaled = image.Pt(img.Width, img.Height)
+	case FitContain:
+		l.scaled = fitInside(srcW, srcH, img.Width, img.Height)
+		l.canvas = image.Pt(img.Width, img.Height)
+		l.offset = l.canvas.Sub(l.scaled).Div(2)
+	default:
+		l.scaled = fitInside(srcW, srcH, img.Width, img.Height)
+	}
+
+	if l.canvas == (image.Point{}) {
+		l.canvas = l.scaled
+	}
+	return l
+}
+
+// fitInside computes the largest size with the aspect ratio of srcW x srcH that fits in boxW x boxH
+func fitInside(srcW, srcH, boxW, boxH int) image.Point {
+	if srcW*boxH > srcH*boxW {
+		return image.Pt(boxW, maxInt(1, (srcH*boxW+srcW/2)/srcW))
+	}
+	return image.Pt(maxInt(1, (srcW*boxH+srcH/2)/srcH), boxH)
+}
+
+// fitOutside computes the smallest size with the aspect ratio of srcW x srcH that covers boxW x boxH
+func fitOutside(srcW, srcH, boxW, boxH int) image.Point {
+	if srcW*boxH > srcH*boxW {
+		return image.Pt(maxInt(1, (srcW*boxH+srcH/2)/srcH), boxH)
+	}
+	return image.Pt(boxW, maxInt(1, (srcH*boxW+srcW/2)/srcW))
+}
+
+// cropToAspect computes the largest region of a srcW x srcH image with the aspect ratio of the box requested
+// by img, positioned around its focal point or, lacking one, according to its gravity
+func cropToAspect(srcW, srcH int, img Imgmeta) image.Rectangle {
+	src := image.Pt(srcW, srcH)
+	size := src
+	if srcW*img.Height > srcH*img.Width {
+		size.X = maxInt(1, (srcH*img.Width+img.Height/2)/img.Height)
+	} else {
+		size.Y = maxInt(1, (srcW*img.Height+img.Width/2)/img.Width)
+	}
+
+	var min image.Point
+	if fp := img.FocalPoint; fp != nil {
+		// Center the region on the focal point, as far as the image borders allow
+		min.X = clampInt(int(fp.X*float64(srcW))-size.X/2, 0, srcW-size.X)
+		min.Y = clampInt(int(fp.Y*float64(srcH))-size.Y/2, 0, srcH-size.Y)
+	} else {
+		anchor, ok := gravityAnchors[img.Gravity]
+		if !ok {
+			anchor = gravityAnchors[GravityCenter]
+		}
+		min.X = int(anchor[0] * float64(srcW-size.X))
+		min.Y = int(anchor[1] * float64(srcH-size.Y))
+	}
+	return image.Rectangle{Min: min, Max: min.Add(size)}
+}
+
+// flatten composites img, in place, onto an opaque background
+func flatten(img *image.RGBA, bg color.NRGBA) {
+	bg.A = 255
+	opaque := image.NewRGBA(img.Bounds())
+	draw.Draw(opaque, opaque.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(opaque, opaque.Bounds(), img, img.Bounds().Min, draw.Over)
+	copy(img.Pix, opaque.Pix)
+}
+
+// toRGBA returns src as an *image.RGBA whose bounds start at the origin, copying only when needed
+func toRGBA(src image.Image) *image.RGBA {
+	if rgba, ok := src.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
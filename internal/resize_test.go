@@ -0,0 +1,438 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+// testImage encodes a width x height gradient as PNG
+func testImage(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode test image: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func Test_NewResizer(t *testing.T) {
+	if _, err := NewResizer("go"); err != nil {
+		t.Errorf("expected go backend to be available, got error: %s", err)
+	}
+	if _, err := NewResizer("imagemagick"); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+}
+
+func Test_GoResizer(t *testing.T) {
+	resizer := NewGoResizer()
+
+	out, err := resizer.Resize(testImage(t, 400, 200), Imgmeta{Original: "test.png", Width: 150, Height: 150})
+	if err != nil {
+		t.Fatalf("failed to resize image: %s", err)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to decode resized image: %s", err)
+	}
+	if e, a := 150, cfg.Width; e != a {
+		t.Errorf("expected width: %v, got width: %v", e, a)
+	}
+	if e, a := 75, cfg.Height; e != a {
+		t.Errorf("expected height: %v, got height: %v", e, a)
+	}
+
+	if _, err := resizer.Resize([]byte("not an image"), Imgmeta{Width: 10, Height: 10}); err == nil {
+		t.Error("expected an error resizing invalid content")
+	}
+}
+
+func Test_GoResizer_formats(t *testing.T) {
+	resizer := NewGoResizer()
+	in := testImage(t, 400, 200)
+
+	tests := []struct {
+		img    Imgmeta
+		format string
+		err    error
+	}{
+		{Imgmeta{Original: "logo.png", Width: 100, Height: 100}, "png", nil},
+		{Imgmeta{Original: "logo.png"}, "png", nil},
+		{Imgmeta{Original: "logo.png", Width: 100, Height: 100, Format: FormatJPEG}, "jpeg", nil},
+		{Imgmeta{Original: "logo.png", Width: 100, Height: 100, Format: FormatGIF}, "gif", nil},
+		{Imgmeta{Original: "logo.png", Width: 100, Height: 100, Format: FormatWebP}, "webp", nil},
+	}
+
+	for _, tt := range tests {
+		out, err := resizer.Resize(in, tt.img)
+		if err != tt.err {
+			t.Errorf("%s: expected error: %v, got error: %v", tt.img.Name(), tt.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if _, format, _ := image.DecodeConfig(bytes.NewReader(out)); format != tt.format {
+			t.Errorf("%s: expected format: %v, got format: %v", tt.img.Name(), tt.format, format)
+		}
+	}
+
+	// WebP originals are read, a 1x1 gray pixel here
+	webp, _ := base64.StdEncoding.DecodeString("UklGRiIAAABXRUJQVlA4IBYAAAAwAQCdASoBAAEADsD+JaQAA3AAAAAA")
+	if _, err := resizer.Resize(webp, Imgmeta{Original: "pixel.webp", Format: FormatPNG}); err != nil {
+		t.Errorf("pixel.webp: expected error: %v, got error: %v", nil, err)
+	}
+
+	// Originals that can't be decoded are not worth retrying
+	if _, err := resizer.Resize([]byte("not an image"), Imgmeta{Original: "logo.png"}); err == nil || !IsPermanent(err) {
+		t.Errorf("expected a permanent error, got error: %v", err)
+	}
+}
+
+func Test_scale(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range src.Pix {
+		src.Pix[i] = 200
+	}
+
+	for _, size := range []image.Point{{16, 16}, {100, 30}, {1, 1}} {
+		dst := scale(src, size.X, size.Y)
+		if dst.Bounds().Size() != size {
+			t.Errorf("expected size: %v, got size: %v", size, dst.Bounds().Size())
+		}
+		// A flat image must stay flat whatever the filter does
+		if c := dst.RGBAAt(size.X/2, size.Y/2); c != (color.RGBA{200, 200, 200, 200}) {
+			t.Errorf("expected flat color to be preserved, got: %v", c)
+		}
+	}
+}
+
+func Test_newLayout(t *testing.T) {
+	tests := []struct {
+		fit    Fit
+		crop   image.Rectangle
+		scaled image.Point
+		canvas image.Point
+		offset image.Point
+	}{
+		{FitInside, image.Rect(0, 0, 400, 200), image.Pt(150, 75), image.Pt(150, 75), image.Pt(0, 0)},
+		{FitContain, image.Rect(0, 0, 400, 200), image.Pt(150, 75), image.Pt(150, 150), image.Pt(0, 37)},
+		{FitCover, image.Rect(100, 0, 300, 200), image.Pt(150, 150), image.Pt(150, 150), image.Pt(0, 0)},
+		{FitFill, image.Rect(0, 0, 400, 200), image.Pt(150, 150), image.Pt(150, 150), image.Pt(0, 0)},
+		{FitOutside, image.Rect(0, 0, 400, 200), image.Pt(300, 150), image.Pt(300, 150), image.Pt(0, 0)},
+	}
+
+	for _, tt := range tests {
+		l := newLayout(400, 200, Imgmeta{Width: 150, Height: 150, Fit: tt.fit})
+		if l.crop != tt.crop || l.scaled != tt.scaled || l.canvas != tt.canvas || l.offset != tt.offset {
+			t.Errorf("%s: expected layout: %v %v %v %v, got layout: %v %v %v %v", tt.fit,
+				tt.crop, tt.scaled, tt.canvas, tt.offset, l.crop, l.scaled, l.canvas, l.offset)
+		}
+	}
+}
+
+func Test_cropToAspect(t *testing.T) {
+	tests := []struct {
+		img  Imgmeta
+		crop image.Rectangle
+	}{
+		{Imgmeta{Width: 100, Height: 100, Gravity: GravityCenter}, image.Rect(100, 0, 300, 200)},
+		{Imgmeta{Width: 100, Height: 100, Gravity: GravityWest}, image.Rect(0, 0, 200, 200)},
+		{Imgmeta{Width: 100, Height: 100, Gravity: GravitySouthEast}, image.Rect(200, 0, 400, 200)},
+		{Imgmeta{Width: 400, Height: 100, Gravity: GravitySouth}, image.Rect(0, 100, 400, 200)},
+		{Imgmeta{Width: 100, Height: 100, FocalPoint: &FocalPoint{X: 0.4, Y: 0.5}}, image.Rect(60, 0, 260, 200)},
+		{Imgmeta{Width: 100, Height: 100, FocalPoint: &FocalPoint{X: 0.95, Y: 0.5}}, image.Rect(200, 0, 400, 200)},
+	}
+
+	for _, tt := range tests {
+		if crop := cropToAspect(400, 200, tt.img); crop != tt.crop {
+			t.Errorf("expected crop: %v, got crop: %v", tt.crop, crop)
+		}
+	}
+}
+
+func Test_smartCrop(t *testing.T) {
+	// A flat gray image with a checkered patch near its right border
+	src := image.NewRGBA(image.Rect(0, 0, 600, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 600; x++ {
+			c := color.RGBA{128, 128, 128, 255}
+			if x >= 450 && x < 550 && y >= 50 && y < 150 && (x/10+y/10)%2 == 0 {
+				c = color.RGBA{255, 255, 255, 255}
+			}
+			src.SetRGBA(x, y, c)
+		}
+	}
+
+	crop := smartCrop(src, image.Pt(200, 200))
+	if crop.Size() != image.Pt(200, 200) {
+		t.Errorf("expected crop size: %v, got crop size: %v", image.Pt(200, 200), crop.Size())
+	}
+	if !image.Rect(450, 50, 550, 150).In(crop) {
+		t.Errorf("expected crop to contain the detailed patch, got crop: %v", crop)
+	}
+}
+
+func Test_ResizeWithinBudget(t *testing.T) {
+	// Noise compresses badly, so the quality has a visible effect on the size
+	src := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	seed := uint32(1)
+	for i := range src.Pix {
+		seed = seed*1664525 + 1013904223
+		src.Pix[i] = uint8(seed >> 24)
+	}
+	var in bytes.Buffer
+	png.Encode(&in, src)
+
+	resizer := NewGoResizer()
+	img := Imgmeta{Original: "noise.jpg", Width: 200, Height: 200, Quality: 90}
+
+	full, _ := resizer.Resize(in.Bytes(), img)
+	img.MaxBytes = len(full) / 2
+	out, quality, err := ResizeWithinBudget(resizer, in.Bytes(), img)
+	if err != nil {
+		t.Fatalf("failed to resize within budget: %s", err)
+	}
+	if len(out) > img.MaxBytes {
+		t.Errorf("expected at most %v bytes, got %v bytes", img.MaxBytes, len(out))
+	}
+	if quality < 1 || quality >= 90 {
+		t.Errorf("expected a quality lower than requested, got quality: %v", quality)
+	}
+
+	// The derivative is drawn once, whatever the number of qualities tried
+	counting := &countingRenderer{GoResizer: newGoResizer()}
+	out, quality, err = ResizeWithinBudget(counting, in.Bytes(), img)
+	if err != nil {
+		t.Fatalf("failed to resize within budget: %s", err)
+	}
+	if counting.renders != 1 {
+		t.Errorf("expected renders: %v, got renders: %v", 1, counting.renders)
+	}
+	settled := img
+	settled.Quality = quality
+	if expected, _ := resizer.Resize(in.Bytes(), settled); !bytes.Equal(out, expected) {
+		t.Errorf("expected the derivative encoded at quality %v", quality)
+	}
+
+	img.MaxBytes = 100
+	if _, _, err := ResizeWithinBudget(resizer, in.Bytes(), img); err != ErrBudgetExceeded {
+		t.Errorf("expected error: %v, got error: %v", ErrBudgetExceeded, err)
+	}
+}
+
+// countingRenderer counts the renderings of a GoResizer
+type countingRenderer struct {
+	GoResizer
+	renders int
+}
+
+func (c *countingRenderer) render(in []byte, img Imgmeta) (encoder, error) {
+	c.renders++
+	return c.GoResizer.render(in, img)
+}
+
+func Test_newLayout_pad(t *testing.T) {
+	tests := []struct {
+		img    Imgmeta
+		scaled image.Point
+		canvas image.Point
+		offset image.Point
+	}{
+		{Imgmeta{Width: 150, Height: 150, Fit: FitContain, Pad: 15}, image.Pt(120, 60), image.Pt(150, 150), image.Pt(15, 45)},
+		{Imgmeta{Width: 150, Height: 150, Fit: FitCover, Pad: 15}, image.Pt(120, 120), image.Pt(150, 150), image.Pt(15, 15)},
+		{Imgmeta{Width: 150, Height: 150, Pad: 15}, image.Pt(120, 60), image.Pt(150, 90), image.Pt(15, 15)},
+		{Imgmeta{Pad: 10}, image.Pt(400, 200), image.Pt(420, 220), image.Pt(10, 10)},
+	}
+
+	for _, tt := range tests {
+		l := newLayout(400, 200, tt.img)
+		if l.scaled != tt.scaled || l.canvas != tt.canvas || l.offset != tt.offset {
+			t.Errorf("%+v: expected layout: %v %v %v, got layout: %v %v %v", tt.img,
+				tt.scaled, tt.canvas, tt.offset, l.scaled, l.canvas, l.offset)
+		}
+	}
+}
+
+func Test_GoResizer_background(t *testing.T) {
+	// A transparent original, letterboxed and converted to JPEG
+	var in bytes.Buffer
+	png.Encode(&in, image.NewNRGBA(image.Rect(0, 0, 200, 100)))
+
+	red := color.NRGBA{R: 255, A: 255}
+	tests := []struct {
+		img   Imgmeta
+		inner color.Color
+		outer color.Color
+	}{
+		{Imgmeta{Width: 100, Height: 100, Fit: FitContain}, color.NRGBA{}, color.NRGBA{}},
+		{Imgmeta{Width: 100, Height: 100, Fit: FitContain, Background: &red}, color.NRGBA{}, red},
+		{Imgmeta{Width: 100, Height: 100, Fit: FitContain, Format: FormatJPEG}, DefaultBackground, DefaultBackground},
+		{Imgmeta{Width: 100, Height: 100, Fit: FitContain, Format: FormatJPEG, Background: &red}, red, red},
+	}
+
+	for _, tt := range tests {
+		tt.img.Original = "test.png"
+		out, err := NewGoResizer().Resize(in.Bytes(), tt.img)
+		if err != nil {
+			t.Fatalf("failed to resize image: %s", err)
+		}
+		dst, _, _ := image.Decode(bytes.NewReader(out))
+		for _, p := range []struct {
+			at       image.Point
+			expected color.Color
+		}{{image.Pt(50, 50), tt.inner}, {image.Pt(50, 5), tt.outer}} {
+			if !similarColors(dst.At(p.at.X, p.at.Y), p.expected) {
+				t.Errorf("%s: expected color: %v at %v, got color: %v", tt.img.Name(), p.expected, p.at, dst.At(p.at.X, p.at.Y))
+			}
+		}
+	}
+}
+
+func Test_GoResizer_icc(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{200, 100, 50, 255}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+	profile := testICCProfile([3][3]float64{
+		{0.515121, 0.291977, 0.157104},
+		{0.241196, 0.692245, 0.066574},
+		{-0.001053, 0.041885, 0.784073},
+	})
+	in := writeMetadata(buf.Bytes(), FormatPNG, metadata{icc: profile})
+
+	tests := []struct {
+		img      Imgmeta
+		expected color.NRGBA
+		icc      bool
+	}{
+		{Imgmeta{Width: 5, Height: 5}, color.NRGBA{215, 93, 31, 255}, false},
+		{Imgmeta{Width: 5, Height: 5, Strip: true}, color.NRGBA{215, 93, 31, 255}, false},
+		{Imgmeta{Width: 5, Height: 5, KeepICC: true}, color.NRGBA{200, 100, 50, 255}, true},
+		{Imgmeta{Width: 5, Height: 5, KeepICC: true, Strip: true}, color.NRGBA{200, 100, 50, 255}, true},
+		// GIFs can't carry the profile, it's converted anyway
+		{Imgmeta{Width: 5, Height: 5, KeepICC: true, Format: FormatGIF}, color.NRGBA{}, false},
+	}
+
+	for _, tt := range tests {
+		tt.img.Original = "test.png"
+		out, err := NewGoResizer().Resize(in, tt.img)
+		if err != nil {
+			t.Fatalf("failed to resize image: %s", err)
+		}
+		// GIFs are quantized to a palette, their colors can't be compared
+		dst, _, _ := image.Decode(bytes.NewReader(out))
+		if tt.img.Format != FormatGIF && !similarColors(dst.At(2, 2), tt.expected) {
+			t.Errorf("%s: expected color: %v, got color: %v", tt.img.Name(), tt.expected, dst.At(2, 2))
+		}
+		if icc := readMetadata(out).icc != nil; icc != tt.icc {
+			t.Errorf("%s: expected icc: %v, got icc: %v", tt.img.Name(), tt.icc, icc)
+		}
+	}
+
+	// Profiles that can't be converted, such as gray or LUT-based ones, stay with the pixels they describe
+	unknown := []byte("not an RGB matrix profile")
+	in = writeMetadata(buf.Bytes(), FormatPNG, metadata{icc: unknown})
+	out, err := NewGoResizer().Resize(in, Imgmeta{Original: "test.png", Width: 5, Height: 5, Strip: true})
+	if err != nil {
+		t.Fatalf("failed to resize image: %s", err)
+	}
+	if icc := readMetadata(out).icc; !bytes.Equal(icc, unknown) {
+		t.Errorf("expected icc: %q, got icc: %q", unknown, icc)
+	}
+}
+
+func Test_GoResizer_animated(t *testing.T) {
+	// Red, then a green square over the left half, then blue; the second frame only covers what it changes
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	pal := color.Palette{red, green, blue}
+	frame := func(r image.Rectangle, c color.Color) *image.Paletted {
+		p := image.NewPaletted(r, pal)
+		draw.Draw(p, r, image.NewUniform(c), image.Point{}, draw.Src)
+		return p
+	}
+	var in bytes.Buffer
+	err := gif.EncodeAll(&in, &gif.GIF{
+		Image:     []*image.Paletted{frame(image.Rect(0, 0, 40, 20), red), frame(image.Rect(0, 0, 20, 20), green), frame(image.Rect(0, 0, 40, 20), blue)},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalNone},
+		LoopCount: 2,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode animation: %s", err)
+	}
+
+	out, err := NewGoResizer().Resize(in.Bytes(), Imgmeta{Original: "test.gif", Width: 20, Height: 10})
+	if err != nil {
+		t.Fatalf("failed to resize image: %s", err)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to decode animation: %s", err)
+	}
+	if len(anim.Image) != 3 || fmt.Sprint(anim.Delay) != "[10 20 30]" || anim.LoopCount != 2 {
+		t.Fatalf("expected frames: %v, delays: %v, loop count: %v, got frames: %v, delays: %v, loop count: %v",
+			3, []int{10, 20, 30}, 2, len(anim.Image), anim.Delay, anim.LoopCount)
+	}
+	var frames []*image.RGBA
+	compositeFrames(anim, len(anim.Image), func(i int, canvas *image.RGBA) error {
+		frame := image.NewRGBA(canvas.Rect)
+		copy(frame.Pix, canvas.Pix)
+		frames = append(frames, frame)
+		return nil
+	})
+	for i, expected := range [][2]color.Color{{red, red}, {green, red}, {blue, blue}} {
+		if size := frames[i].Bounds().Size(); size != image.Pt(20, 10) {
+			t.Errorf("frame %d: expected size: %v, got size: %v", i, image.Pt(20, 10), size)
+		}
+		for j, at := range []image.Point{image.Pt(2, 5), image.Pt(17, 5)} {
+			if !similarColors(frames[i].At(at.X, at.Y), expected[j]) {
+				t.Errorf("frame %d: expected color: %v at %v, got color: %v", i, expected[j], at, frames[i].At(at.X, at.Y))
+			}
+		}
+	}
+
+	// A still of the second frame, composited over the first one
+	frameIndex := 1
+	out, err = NewGoResizer().Resize(in.Bytes(), Imgmeta{Original: "test.gif", Frame: &frameIndex, Format: FormatPNG})
+	if err != nil {
+		t.Fatalf("failed to resize image: %s", err)
+	}
+	still, format, _ := image.Decode(bytes.NewReader(out))
+	if format != "png" || !similarColors(still.At(5, 10), green) || !similarColors(still.At(35, 10), red) {
+		t.Errorf("expected a png still of green and red, got %s still: %v and %v", format, still.At(5, 10), still.At(35, 10))
+	}
+
+	frameIndex = 3
+	if _, err = NewGoResizer().Resize(in.Bytes(), Imgmeta{Original: "test.gif", Frame: &frameIndex}); err != ErrFrameOutOfBounds {
+		t.Errorf("expected err: %v, got err: %v", ErrFrameOutOfBounds, err)
+	}
+}
+
+// similarColors compares colors with some tolerance for lossy encoding
+func similarColors(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	for _, d := range []int{int(ar) - int(br), int(ag) - int(bg), int(ab) - int(bb), int(aa) - int(ba)} {
+		if d > 0x800 || d < -0x800 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+//go:build vips
+// +build vips
+
+package internal
+
+import (
+	"github.com/daddye/vips"
+)
+
+func init() {
+	resizers["vips"] = NewVipsResizer
+}
+
+// VipsResizer resizes images with libvips; it is only compiled in with the "vips" build tag.
+// Requests the libvips bindings can't express are handed over to the pure-Go backend, progressive JPEGs
+// among them: the API must run with -progressive=false for libvips to produce JPEGs at all.
+type VipsResizer struct {
+	fallback GoResizer
+}
+
+func NewVipsResizer(opts ...ResizerOption) Resizer {
+	return VipsResizer{fallback: newGoResizer(opts...)}
+}
+
+func (v VipsResizer) Resize(in []byte, img Imgmeta) ([]byte, error) {
+	if !v.handles(in, img) {
+		return v.fallback.Resize(in, img)
+	}
+	return v.resize(in, img)
+}
+
+// render lets byte budget searches encode the renderings of the fallback again;
+// libvips renders and encodes in one go, so its derivatives go through the whole pipeline
+func (v VipsResizer) render(in []byte, img Imgmeta) (encoder, error) {
+	if !v.handles(in, img) {
+		return v.fallback.render(in, img)
+	}
+	return func(img Imgmeta) ([]byte, error) {
+		return v.resize(in, img)
+	}, nil
+}
+
+// handles tells whether libvips produces img out of in, rather than the fallback
+func (v VipsResizer) handles(in []byte, img Imgmeta) bool {
+	// The bindings neither auto-orient nor convert color profiles; sRGB ones need no conversion,
+	// though they must be kept when asked for, and the bindings strip them
+	md := readMetadata(in)
+	return v.supports(img) && exifOrientation(md.exif) == 1 &&
+		(md.icc == nil || !img.KeepICC && isSRGBProfile(md.icc))
+}
+
+func (v VipsResizer) resize(in []byte, img Imgmeta) ([]byte, error) {
+	// The size policy has ruled on upscaling already; left alone, the bindings would clamp each dimension
+	// to the original on their own, where the Go backend produces the size asked for
+	options := vips.Options{
+		Width:   img.Width,
+		Height:  img.Height,
+		Crop:    img.Fit == FitCover,
+		Enlarge: true,
+		Gravity: vipsGravities[img.Gravity],
+		Quality: img.Quality,
+	}
+	if options.Quality == 0 {
+		options.Quality = 100
+	}
+	setVipsFormat(&options, img.OutputFormat())
+	return vips.Resize(in, options)
+}
+
+// supports tells whether img can be produced by libvips alone
+func (v VipsResizer) supports(img Imgmeta) bool {
+	// The bindings neither interlace, control metadata, extract frames, rotate, crop regions, filter nor composite
+	if img.Width == 0 || img.Height == 0 || img.Progressive || !img.Strip ||
+		img.Frame != nil || img.Rotate != 0 || img.Flip != "" || img.NoOrient || img.Crop != nil || !img.Filters.IsZero() ||
+		img.Watermark != nil || img.Text != nil {
+		return false
+	}
+	// Their letterboxes are black whatever the background and the output format
+	switch img.Fit {
+	case FitFill, FitOutside, FitContain:
+		return false
+	}
+	// Neither do they pad, nor flatten transparency onto a chosen color
+	if img.Pad != 0 || img.Background != nil ||
+		!img.OutputFormat().HasAlpha() && FormatFromFilename(img.Original).HasAlpha() {
+		return false
+	}
+	// Nor cut images to masks
+	if img.Radius != 0 || img.Mask != "" {
+		return false
+	}
+	// The bindings read WebP, but only write JPEG and PNG
+	switch FormatFromFilename(img.Original) {
+	case FormatJPEG, FormatPNG, FormatWebP:
+	default:
+		return false
+	}
+	if !setVipsFormat(&vips.Options{}, img.OutputFormat()) {
+		return false
+	}
+	if _, ok := vipsGravities[img.Gravity]; img.Gravity != "" && !ok {
+		return false
+	}
+	return img.FocalPoint == nil
+}
+
+// vipsGravities maps the gravities the libvips bindings know of
+var vipsGravities = map[Gravity]vips.Gravity{
+	GravityCenter: vips.CENTRE,
+	GravityNorth:  vips.NORTH,
+	GravityEast:   vips.EAST,
+	GravitySouth:  vips.SOUTH,
+	GravityWest:   vips.WEST,
+}
+
+// setVipsFormat sets the output format of options, telling whether the libvips bindings can encode it;
+// they accept vips.WEBP but save nothing for it
+func setVipsFormat(options *vips.Options, format Format) bool {
+	switch format {
+	case FormatJPEG:
+		options.Format = vips.JPEG
+	case FormatPNG:
+		options.Format = vips.PNG
+	default:
+		return false
+	}
+	return true
+}
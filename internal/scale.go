@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// scale resamples src to width x height with a Catmull-Rom filter.
+// Pixels are processed premultiplied, so transparent edges do not bleed dark fringes.
+func scale(src image.Image, width, height int) *image.RGBA {
+	in := toRGBA(src)
+	if in.Rect.Dx() == width && in.Rect.Dy() == height {
+		return in
+	}
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(out, out.Bounds(), in, in.Bounds(), draw.Src, nil)
+	return out
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func clampFloat(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"image"
+	"math"
+)
+
+const (
+	// smartCropSize is the longest side of the thumbnail crop windows are scored on
+	smartCropSize = 256
+	// smartCropSteps is the number of candidate positions tried along the sliding axis
+	smartCropSteps = 32
+	// smartCropCenterBias slightly favours central windows when scores are close
+	smartCropCenterBias = 0.1
+)
+
+// smartCrop slides a window of the given size along src, which is always as wide or as tall as the
+// window, and returns the position where the window covers the most interesting region: the one with
+// the highest density of edges and the richest luminance histogram.
+func smartCrop(src *image.RGBA, size image.Point) image.Rectangle {
+	bounds := src.Bounds().Size()
+	if size.X >= bounds.X && size.Y >= bounds.Y {
+		return image.Rectangle{Max: bounds}
+	}
+
+	// Score windows on a thumbnail; it is both faster and less sensitive to noise
+	ratio := math.Min(1, float64(smartCropSize)/float64(maxInt(bounds.X, bounds.Y)))
+	thumbSize := image.Pt(maxInt(1, int(float64(bounds.X)*ratio)), maxInt(1, int(float64(bounds.Y)*ratio)))
+	lum := luminance(scale(src, thumbSize.X, thumbSize.Y))
+	edges := integral(sobel(lum, thumbSize), thumbSize)
+
+	window := image.Pt(minInt(thumbSize.X, maxInt(1, int(float64(size.X)*ratio))),
+		minInt(thumbSize.Y, maxInt(1, int(float64(size.Y)*ratio))))
+	slack := thumbSize.Sub(window)
+	travel := maxInt(slack.X, slack.Y)
+
+	type candidate struct {
+		min            image.Point
+		edges, entropy float64
+	}
+	var candidates []candidate
+	var maxEdges, maxEntropy float64
+	for step := 0; step <= smartCropSteps; step++ {
+		offset := travel * step / smartCropSteps
+		min := image.Pt(offset, 0)
+		if slack.Y > slack.X {
+			min = image.Pt(0, offset)
+		}
+		r := image.Rectangle{Min: min, Max: min.Add(window)}
+		c := candidate{
+			min:     min,
+			edges:   edges.sum(r) / float64(window.X*window.Y),
+			entropy: entropy(lum, thumbSize.X, r),
+		}
+		maxEdges = math.Max(maxEdges, c.edges)
+		maxEntropy = math.Max(maxEntropy, c.entropy)
+		candidates = append(candidates, c)
+	}
+
+	best, bestScore := candidates[len(candidates)/2], math.Inf(-1)
+	for i, c := range candidates {
+		var score float64
+		if maxEdges > 0 {
+			score += 0.6 * c.edges / maxEdges
+		}
+		if maxEntropy > 0 {
+			score += 0.4 * c.entropy / maxEntropy
+		}
+		score -= smartCropCenterBias * math.Abs(float64(i)/smartCropSteps-0.5) * 2
+		if score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+
+	// Map the winning window back onto the full size image
+	min := image.Pt(int(float64(best.min.X)/ratio), int(float64(best.min.Y)/ratio))
+	min.X = clampInt(min.X, 0, bounds.X-size.X)
+	min.Y = clampInt(min.Y, 0, bounds.Y-size.Y)
+	return image.Rectangle{Min: min, Max: min.Add(size)}
+}
+
+// luminance extracts the Rec. 601 luma of an image, as one byte per pixel
+func luminance(img *image.RGBA) []uint8 {
+	size := img.Bounds().Size()
+	lum := make([]uint8, size.X*size.Y)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			p := img.Pix[y*img.Stride+x*4:]
+			lum[y*size.X+x] = uint8((299*int(p[0]) + 587*int(p[1]) + 114*int(p[2])) / 1000)
+		}
+	}
+	return lum
+}
+
+// sobel computes the gradient magnitude of a luminance map
+func sobel(lum []uint8, size image.Point) []float64 {
+	at := func(x, y int) float64 {
+		return float64(lum[clampInt(y, 0, size.Y-1)*size.X+clampInt(x, 0, size.X-1)])
+	}
+	out := make([]float64, len(lum))
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			out[y*size.X+x] = math.Sqrt(gx*gx + gy*gy)
+		}
+	}
+	return out
+}
+
+// summedArea is an integral image, answering rectangle sums in constant time
+type summedArea struct {
+	sums  []float64
+	width int
+}
+
+func integral(values []float64, size image.Point) summedArea {
+	width := size.X + 1
+	sums := make([]float64, width*(size.Y+1))
+	for y := 0; y < size.Y; y++ {
+		var row float64
+		for x := 0; x < size.X; x++ {
+			row += values[y*size.X+x]
+			sums[(y+1)*width+x+1] = sums[y*width+x+1] + row
+		}
+	}
+	return summedArea{sums: sums, width: width}
+}
+
+func (s summedArea) sum(r image.Rectangle) float64 {
+	return s.sums[r.Max.Y*s.width+r.Max.X] - s.sums[r.Min.Y*s.width+r.Max.X] -
+		s.sums[r.Max.Y*s.width+r.Min.X] + s.sums[r.Min.Y*s.width+r.Min.X]
+}
+
+// entropy computes the Shannon entropy, in bits, of the luminance histogram of a region
+func entropy(lum []uint8, width int, r image.Rectangle) float64 {
+	var histogram [32]int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			histogram[lum[y*width+x]>>3]++
+		}
+	}
+
+	total := float64(r.Dx() * r.Dy())
+	var h float64
+	for _, n := range histogram {
+		if n > 0 {
+			p := float64(n) / total
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
@@ -21,7 +22,14 @@ type ImageStore interface {
 	Has(img Imgmeta) (bool, error)
 	LoadNew() ([]Imgmeta, error) // todo decide whether we need it or not
 	Save(img Imgmeta, content []byte) error
+	SaveQuality(img Imgmeta, quality int) error
 	Serve(rw http.ResponseWriter, img Imgmeta) error
+	Size(img Imgmeta) (width, height int, err error)
+	FrameCount(original string) (int, error)
+	Placeholder(original string, placeholderType PlaceholderType) (Placeholder, error)
+	Palette(job PaletteJob) (p Palette, ok bool, err error)
+	SavePalette(job PaletteJob, p Palette) error
+	Info(original string) (Info, error)
 	Count() (int, error)
 }
 
@@ -94,6 +102,11 @@ func (r RedisCachedLocalImageStore) Save(img Imgmeta, content []byte) error {
 	return nil
 }
 
+// SaveQuality records the encoder quality a derivative was eventually produced with
+func (r RedisCachedLocalImageStore) SaveQuality(img Imgmeta, quality int) error {
+	return r.client.Set("quality:"+img.Name(), quality, 0).Err()
+}
+
 //Serve makes RedisCachedLocalImageStore implement http.Handler
 func (r RedisCachedLocalImageStore) Serve(w http.ResponseWriter, img Imgmeta) error {
 	imgFile, err := os.Open(path.Join(r.basepath, img.Name()))
@@ -107,9 +120,14 @@ func (r RedisCachedLocalImageStore) Serve(w http.ResponseWriter, img Imgmeta) er
 		return errors.New("failed to read file stats: " + err.Error())
 	}
 
-	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Type", FormatFromFilename(img.Name()).MIMEType(img.Name()))
 	w.Header().Set("Content-Length", strconv.Itoa(int(fileInfo.Size())))
 	w.Header().Set("Last-Modified", fileInfo.ModTime().Format(time.RFC1123))
+	if img.MaxBytes > 0 {
+		if quality, err := r.client.Get("quality:" + img.Name()).Result(); err == nil {
+			w.Header().Set("X-Image-Quality", quality)
+		}
+	}
 
 	_, err = io.Copy(w, imgFile)
 	return err
@@ -129,8 +147,186 @@ func (r RedisCachedLocalImageStore) Count() (int, error) {
 	return i, nil
 }
 
+// sizePrefix is what is read of originals to learn their size, enough for the headers and EXIF of most
+const sizePrefix = 256 << 10
+
+// Size reads the dimensions of the original of img, once oriented, rotated and cropped as img asks
+func (r RedisCachedLocalImageStore) Size(img Imgmeta) (width, height int, err error) {
+	f, err := os.Open(filepath.Join(r.basepath, img.Original))
+	if os.IsNotExist(err) {
+		return 0, 0, ErrOriginalNotFound
+	}
+	if err != nil {
+		return 0, 0, errors.New("error opening file info")
+	}
+	defer f.Close()
+
+	// Headers and EXIF come first, the rest of originals is only read when large metadata pushed them further
+	data, err := ioutil.ReadAll(io.LimitReader(f, sizePrefix))
+	if err != nil {
+		return 0, 0, errors.New("error opening file info")
+	}
+	width, height, err = SourceSize(data, img)
+	if _, ok := err.(decodeError); ok && len(data) == sizePrefix {
+		var rest []byte
+		if rest, err = ioutil.ReadAll(f); err != nil {
+			return 0, 0, errors.New("error opening file info")
+		}
+		width, height, err = SourceSize(append(data, rest...), img)
+	}
+	if err == ErrCropOutOfBounds {
+		return 0, 0, err
+	}
+	if err != nil {
+		return 0, 0, errors.New("error reading file info")
+	}
+	return width, height, nil
+}
+
+// FrameCount counts the frames of an original, without decoding them
+func (r RedisCachedLocalImageStore) FrameCount(original string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.basepath, original))
+	if os.IsNotExist(err) {
+		return 0, ErrOriginalNotFound
+	}
+	if err != nil {
+		return 0, errors.New("error opening file info")
+	}
+	count, err := frameCount(data)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("failed to count frames: %s", err))
+	}
+	return count, nil
+}
+
+// originalKey scopes a cache key to the version of an original on disk, so that what was computed from it
+// isn't served anymore once it is replaced
+func (r RedisCachedLocalImageStore) originalKey(prefix, original string) (string, error) {
+	fileInfo, err := os.Stat(filepath.Join(r.basepath, original))
+	if os.IsNotExist(err) {
+		return "", ErrOriginalNotFound
+	}
+	if err != nil {
+		return "", errors.New("failed to read file stats: " + err.Error())
+	}
+	return fmt.Sprintf("%s:%d:%s", prefix, fileInfo.ModTime().UnixNano(), original), nil
+}
+
+// Placeholder reads the placeholder of an original from Redis, computing it on the first request
+func (r RedisCachedLocalImageStore) Placeholder(original string, placeholderType PlaceholderType) (Placeholder, error) {
+	var p Placeholder
+	key, err := r.originalKey("placeholder:"+string(placeholderType), original)
+	if err != nil {
+		return p, err
+	}
+	cached, err := r.client.Get(key).Result()
+	if err == nil {
+		if err = json.Unmarshal([]byte(cached), &p); err == nil {
+			return p, nil
+		}
+		log.Printf("failed to decode a cached placeholder: %s\n", err)
+	} else if err != redis.Nil {
+		return p, errors.New(fmt.Sprintf("failed to read placeholder from Redis: %s", err))
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(r.basepath, original))
+	if os.IsNotExist(err) {
+		return p, ErrOriginalNotFound
+	}
+	if err != nil {
+		return p, errors.New("error opening file info")
+	}
+	p, err = NewPlaceholder(data, placeholderType)
+	if err != nil {
+		return p, err
+	}
+
+	enc, err := json.Marshal(p)
+	if err != nil {
+		return p, errors.New(fmt.Sprintf("failed to encode placeholder to json: %s", err))
+	}
+	// The placeholder is computed already, failing to cache it only costs computing it again
+	if err = r.client.Set(key, enc, 0).Err(); err != nil {
+		log.Printf("failed to cache a placeholder: %s\n", err)
+	}
+	return p, nil
+}
+
+// Palette reads the palette of an original from Redis; ok is false until a worker computed it
+func (r RedisCachedLocalImageStore) Palette(job PaletteJob) (p Palette, ok bool, err error) {
+	key, err := r.paletteKey(job)
+	if err != nil {
+		return p, false, err
+	}
+	cached, err := r.client.Get(key).Result()
+	if err == redis.Nil {
+		return p, false, nil
+	}
+	if err != nil {
+		return p, false, errors.New(fmt.Sprintf("failed to read palette from Redis: %s", err))
+	}
+	if err = json.Unmarshal([]byte(cached), &p); err != nil {
+		return p, false, errors.New(fmt.Sprintf("failed to decode palette from json: %s", err))
+	}
+	return p, true, nil
+}
+
+// SavePalette caches the palette of an original in Redis
+func (r RedisCachedLocalImageStore) SavePalette(job PaletteJob, p Palette) error {
+	enc, err := json.Marshal(p)
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to encode palette to json: %s", err))
+	}
+	key, err := r.paletteKey(job)
+	if err != nil {
+		return err
+	}
+	return r.client.Set(key, enc, 0).Err()
+}
+
+// paletteKey identifies a palette in the cache, for the version of the original it was computed from
+func (r RedisCachedLocalImageStore) paletteKey(job PaletteJob) (string, error) {
+	return r.originalKey(fmt.Sprintf("colors:%d", job.Count), job.Original)
+}
+
+// Info reads what there is to know about an original, along with the derivatives made of it
+func (r RedisCachedLocalImageStore) Info(original string) (Info, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.basepath, original))
+	if os.IsNotExist(err) {
+		return Info{}, ErrOriginalNotFound
+	}
+	if err != nil {
+		return Info{}, errors.New("error opening file info")
+	}
+	info, err := NewInfo(data)
+	if err != nil {
+		return Info{}, err
+	}
+
+	fileInfo, err := os.Stat(filepath.Join(r.basepath, original))
+	if err != nil {
+		return Info{}, errors.New("failed to read file stats: " + err.Error())
+	}
+	info.Size, info.ModTime = fileInfo.Size(), fileInfo.ModTime()
+
+	files, err := ioutil.ReadDir(r.basepath)
+	if err != nil {
+		return Info{}, errors.New(fmt.Sprintf("failed to read files from disk: %s", err))
+	}
+	for _, f := range files {
+		if !f.IsDir() && IsDerivativeName(f.Name(), original) {
+			info.Derivatives = append(info.Derivatives, f.Name())
+		}
+	}
+	return info, nil
+}
+
 func (r RedisCachedLocalImageStore) readImageSize(img Imgmeta) (width, height int, err error) {
-	if reader, err := os.Open(filepath.Join(r.basepath, img.Original)); err == nil {
+	reader, err := os.Open(filepath.Join(r.basepath, img.Original))
+	if os.IsNotExist(err) {
+		return 0, 0, ErrOriginalNotFound
+	}
+	if err == nil {
 		defer reader.Close()
 		im, _, err := image.DecodeConfig(reader)
 		if err != nil {
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_RedisCachedLocalImageStore_Size(t *testing.T) {
+	dir, err := ioutil.TempDir("", "originals")
+	if err != nil {
+		t.Fatalf("failed to create the originals directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 400, 200)), nil)
+
+	// A landscape image its EXIF tells to turn 90 degrees clockwise, with a profile pushing its header
+	// past what is read of it at first
+	exif := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	originals := map[string]metadata{
+		"small.jpg": {exif: exif},
+		"large.jpg": {exif: exif, icc: make([]byte, 2*sizePrefix)},
+	}
+	for name, md := range originals {
+		ioutil.WriteFile(filepath.Join(dir, name), writeMetadata(buf.Bytes(), FormatJPEG, md), 0644)
+	}
+
+	store := RedisCachedLocalImageStore{basepath: dir}
+	for name := range originals {
+		width, height, err := store.Size(Imgmeta{Original: name})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", name, err)
+			continue
+		}
+		if width != 200 || height != 400 {
+			t.Errorf("%s: expected size: 200x400, got size: %vx%v", name, width, height)
+		}
+	}
+
+	if _, _, err := store.Size(Imgmeta{Original: "missing.jpg"}); err != ErrOriginalNotFound {
+		t.Errorf("expected error: %v, got error: %v", ErrOriginalNotFound, err)
+	}
+}
+
+func Test_RedisCachedLocalImageStore_originalKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "originals")
+	if err != nil {
+		t.Fatalf("failed to create the originals directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "test.jpg"), []byte("test"), 0644)
+
+	store := RedisCachedLocalImageStore{basepath: dir}
+	key, err := store.originalKey("placeholder:blurhash", "test.jpg")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Replacing the original gives it another key
+	mtime := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(dir, "test.jpg"), mtime, mtime)
+	replaced, err := store.originalKey("placeholder:blurhash", "test.jpg")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if replaced == key {
+		t.Errorf("expected key other than: %v, got key: %v", key, replaced)
+	}
+
+	if _, err := store.originalKey("placeholder:blurhash", "missing.jpg"); err != ErrOriginalNotFound {
+		t.Errorf("expected error: %v, got error: %v", ErrOriginalNotFound, err)
+	}
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	fontNameRegexp  = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._-]*$")
+	ErrInvalidText  = errors.New("text must be at most 100 characters long")
+	ErrInvalidFont  = errors.New("font must be the file name of a font")
+	ErrUnknownFont  = errors.New("font not found")
+	ErrInvalidSize  = errors.New("textsize must be an integer between 1 and 500")
+	ErrInvalidColor = errors.New("colors must be formatted as RRGGBB or RRGGBBAA")
+)
+
+// bundledFonts are always available, so text can be rendered without any font installed
+var bundledFonts = map[string][]byte{
+	"go-regular": goregular.TTF,
+	"go-bold":    gobold.TTF,
+}
+
+// TextOverlay is a line of text drawn onto a derivative, after its watermark
+type TextOverlay struct {
+	Text     string       `json:"text"`
+	Font     string       `json:"font"`
+	Size     int          `json:"size"` // in pixels
+	Color    color.NRGBA  `json:"color"`
+	Position Gravity      `json:"position"`
+	Shadow   *color.NRGBA `json:"shadow,omitempty"`
+}
+
+// DefaultTextOverlay is what the options of a requested text default to
+var DefaultTextOverlay = TextOverlay{
+	Font:     "go-regular",
+	Size:     24,
+	Color:    color.NRGBA{R: 255, G: 255, B: 255, A: 255},
+	Position: GravityNorthWest,
+}
+
+// Hash identifies the overlay in derivative names, which can't hold arbitrary text
+func (t TextOverlay) Hash() string {
+	data, _ := json.Marshal(t)
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:5])
+}
+
+// draw renders the text onto dst, half its size away from the edges, with its shadow offset
+// by a sixteenth of its size; text wider than dst is cut
+func (t TextOverlay) draw(dst *image.RGBA, f *opentype.Font) error {
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: float64(t.Size), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to load font: %s", err))
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	box := image.Pt(font.MeasureString(face, t.Text).Ceil(), (metrics.Ascent + metrics.Descent).Ceil())
+	margin := t.Size / 2
+	room := dst.Bounds().Size().Sub(image.Pt(2*margin, 2*margin))
+	anchor := gravityAnchors[t.Position]
+	x := margin + int(anchor[0]*float64(room.X-box.X))
+	y := margin + int(anchor[1]*float64(room.Y-box.Y))
+	dot := fixed.P(x, y).Add(fixed.Point26_6{Y: metrics.Ascent})
+
+	drawer := font.Drawer{Dst: dst, Face: face}
+	if t.Shadow != nil {
+		offset := maxInt(1, t.Size/16)
+		drawer.Src = image.NewUniform(*t.Shadow)
+		drawer.Dot = dot.Add(fixed.P(offset, offset))
+		drawer.DrawString(t.Text)
+	}
+	drawer.Src = image.NewUniform(t.Color)
+	drawer.Dot = dot
+	drawer.DrawString(t.Text)
+	return nil
+}
+
+// Fonts is the directory TTF and OTF fonts are read from, on top of the bundled ones
+type Fonts struct {
+	dir string
+}
+
+func NewFonts(dir string) Fonts {
+	return Fonts{dir: dir}
+}
+
+// Has tells whether there is a font of the given name
+func (f Fonts) Has(name string) bool {
+	if _, ok := bundledFonts[name]; ok {
+		return true
+	}
+	if f.dir == "" || !fontNameRegexp.MatchString(name) {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(f.dir, name))
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (f Fonts) load(name string) (*opentype.Font, error) {
+	if !f.Has(name) {
+		return nil, ErrUnknownFont
+	}
+	data, ok := bundledFonts[name]
+	if !ok {
+		var err error
+		if data, err = ioutil.ReadFile(filepath.Join(f.dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	parsed, err := opentype.Parse(data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to parse font: %s", err))
+	}
+	return parsed, nil
+}
+
+// ParseColor reads a color formatted as RRGGBB or RRGGBBAA
+func ParseColor(s string) (color.NRGBA, error) {
+	if len(s) != 6 && len(s) != 8 {
+		return color.NRGBA{}, ErrInvalidColor
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return color.NRGBA{}, ErrInvalidColor
+	}
+	c := color.NRGBA{R: b[0], G: b[1], B: b[2], A: 255}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+	return c, nil
+}
+
+// colorHex formats a color as ParseColor reads it, leaving out the alpha of opaque colors
+func colorHex(c color.NRGBA) string {
+	if c.A == 255 {
+		return fmt.Sprintf("%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_TextOverlay(t *testing.T) {
+	var in bytes.Buffer
+	png.Encode(&in, image.NewRGBA(image.Rect(0, 0, 200, 100)))
+
+	red := color.NRGBA{R: 255, A: 255}
+	overlay := DefaultTextOverlay
+	overlay.Text = "NEW"
+	overlay.Size = 32
+	overlay.Shadow = &red
+
+	resizer := NewGoResizer(WithResizerFonts(NewFonts("")))
+	out, err := resizer.Resize(in.Bytes(), Imgmeta{Original: "test.png", Text: &overlay})
+	if err != nil {
+		t.Fatalf("failed to resize image: %s", err)
+	}
+	dst, _, _ := image.Decode(bytes.NewReader(out))
+
+	// White text in the top left quarter, with a red shadow, and nothing elsewhere
+	var white, shadow int
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			r, g, _, _ := dst.At(x, y).RGBA()
+			switch {
+			case r == 0:
+				continue
+			case x >= 100 || y >= 50:
+				t.Fatalf("expected text in the top left quarter, got color: %v at %v,%v", dst.At(x, y), x, y)
+			case g == 0xffff:
+				white++
+			case g == 0:
+				shadow++
+			}
+		}
+	}
+	if white == 0 || shadow == 0 {
+		t.Errorf("expected white text with a red shadow, got white pixels: %v, shadow pixels: %v", white, shadow)
+	}
+
+	overlay.Font = "missing.ttf"
+	if _, err := resizer.Resize(in.Bytes(), Imgmeta{Original: "test.png", Text: &overlay}); err != ErrUnknownFont {
+		t.Errorf("expected error: %v, got error: %v", ErrUnknownFont, err)
+	}
+}
+
+func Test_TextOverlay_Hash(t *testing.T) {
+	name := func(q string) string {
+		query, _ := url.ParseQuery(q)
+		img, err := NewImageFromRequest("landscape.jpg", query)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", q, err)
+		}
+		return img.Name()
+	}
+
+	a := name("text=NEW&textcolor=FF0000&textsize=32")
+	if b := name("textsize=32&textcolor=ff0000&text=NEW"); a != b {
+		t.Errorf("expected the same name for the same overlay, got names: %v and %v", a, b)
+	}
+	if b := name("text=OLD&textcolor=ff0000&textsize=32"); a == b {
+		t.Errorf("expected different names for different texts, got name: %v", a)
+	}
+	if !strings.HasPrefix(a, "landscape_text-") {
+		t.Errorf("expected a text overlay name, got name: %v", a)
+	}
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+var (
+	watermarkNameRegexp     = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9._-]*$")
+	ErrInvalidWatermark     = errors.New("wm must be the file name of a watermark")
+	ErrUnknownWatermark     = errors.New("watermark not found")
+	ErrInvalidWatermarkSize = errors.New("wmopacity and wmscale must be numbers between 0 and 1, wmmargin an integer between 0 and 1000")
+)
+
+// Watermark is an overlay image composited onto a derivative, after its filters
+type Watermark struct {
+	Name     string  `json:"name"` // file name in the watermarks directory
+	Position Gravity `json:"position"`
+	Opacity  float64 `json:"opacity"` // 0 to 1
+	Margin   int     `json:"margin"`  // distance to the edges of the derivative, in pixels
+	Scale    float64 `json:"scale"`   // width relative to the derivative's, 0 keeps the natural size
+}
+
+// DefaultWatermark is what the options of a requested watermark default to
+var DefaultWatermark = Watermark{Position: GravitySouthEast, Opacity: 1}
+
+func (w Watermark) String() string {
+	return fmt.Sprintf("%s-%s-o%s-m%d-s%s", w.Name, w.Position, strconv.FormatFloat(w.Opacity, 'f', -1, 64),
+		w.Margin, strconv.FormatFloat(w.Scale, 'f', -1, 64))
+}
+
+// draw composites overlay onto dst; overlays larger than the room left by the margins are shrunk to fit
+func (w Watermark) draw(dst *image.RGBA, overlay *image.RGBA) {
+	size := dst.Bounds().Size()
+	ov := overlay.Bounds().Size()
+	if w.Scale > 0 {
+		width := maxInt(1, int(math.Round(float64(size.X)*w.Scale)))
+		ov = image.Pt(width, maxInt(1, int(math.Round(float64(width)*float64(ov.Y)/float64(ov.X)))))
+	}
+	room := image.Pt(maxInt(1, size.X-2*w.Margin), maxInt(1, size.Y-2*w.Margin))
+	if ov.X > room.X || ov.Y > room.Y {
+		ov = fitInside(ov.X, ov.Y, room.X, room.Y)
+	}
+	if ov != overlay.Bounds().Size() {
+		overlay = scale(overlay, ov.X, ov.Y)
+	}
+
+	anchor := gravityAnchors[w.Position]
+	min := image.Pt(w.Margin+int(math.Round(anchor[0]*float64(room.X-ov.X))),
+		w.Margin+int(math.Round(anchor[1]*float64(room.Y-ov.Y))))
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(w.Opacity * 255))})
+	draw.DrawMask(dst, image.Rectangle{Min: min, Max: min.Add(ov)}, overlay, overlay.Bounds().Min, mask, image.Point{}, draw.Over)
+}
+
+// Watermarks is the directory overlay images are read from
+type Watermarks struct {
+	dir string
+}
+
+func NewWatermarks(dir string) Watermarks {
+	return Watermarks{dir: dir}
+}
+
+// Has tells whether there is a watermark of the given name
+func (w Watermarks) Has(name string) bool {
+	if w.dir == "" || !watermarkNameRegexp.MatchString(name) {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(w.dir, name))
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (w Watermarks) load(name string) (*image.RGBA, error) {
+	if !w.Has(name) {
+		return nil, ErrUnknownWatermark
+	}
+	f, err := os.Open(filepath.Join(w.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	overlay, _, err := image.Decode(f)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode watermark: %s", err))
+	}
+	return toRGBA(overlay), nil
+}
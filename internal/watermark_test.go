@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Watermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watermarks")
+	if err != nil {
+		t.Fatalf("failed to create the watermarks dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An opaque white square
+	square := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(square, square.Bounds(), image.White, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	png.Encode(&buf, square)
+	ioutil.WriteFile(filepath.Join(dir, "logo.png"), buf.Bytes(), 0644)
+
+	watermarks := NewWatermarks(dir)
+	if !watermarks.Has("logo.png") || watermarks.Has("missing.png") || watermarks.Has("../logo.png") {
+		t.Errorf("expected only logo.png to be a watermark")
+	}
+
+	resizer := NewGoResizer(WithResizerWatermarks(watermarks))
+	black := func() []byte {
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 200, 100)))
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		wm      Watermark
+		inside  image.Point
+		outside image.Point
+		alpha   uint32
+	}{
+		{Watermark{Name: "logo.png", Position: GravitySouthEast, Opacity: 1}, image.Pt(190, 90), image.Pt(170, 90), 0xffff},
+		{Watermark{Name: "logo.png", Position: GravityNorthWest, Opacity: 1, Margin: 10}, image.Pt(15, 15), image.Pt(5, 5), 0xffff},
+		{Watermark{Name: "logo.png", Position: GravityCenter, Opacity: 1, Scale: 0.5}, image.Pt(60, 30), image.Pt(40, 50), 0xffff},
+		{Watermark{Name: "logo.png", Position: GravitySouthEast, Opacity: 0.5}, image.Pt(190, 90), image.Pt(170, 90), 0x8080},
+	}
+
+	for _, tt := range tests {
+		wm := tt.wm
+		out, err := resizer.Resize(black(), Imgmeta{Original: "test.png", Watermark: &wm})
+		if err != nil {
+			t.Fatalf("failed to resize image: %s", err)
+		}
+		dst, _, _ := image.Decode(bytes.NewReader(out))
+		if r, _, _, _ := dst.At(tt.inside.X, tt.inside.Y).RGBA(); r != tt.alpha {
+			t.Errorf("%v: expected watermark at %v with intensity: %x, got intensity: %x", wm, tt.inside, tt.alpha, r)
+		}
+		if r, _, _, _ := dst.At(tt.outside.X, tt.outside.Y).RGBA(); r != 0 {
+			t.Errorf("%v: expected no watermark at %v, got intensity: %x", wm, tt.outside, r)
+		}
+	}
+
+	if _, err := resizer.Resize(black(), Imgmeta{Original: "test.png", Watermark: &Watermark{Name: "missing.png"}}); err != ErrUnknownWatermark {
+		t.Errorf("expected error: %v, got error: %v", ErrUnknownWatermark, err)
+	}
+}
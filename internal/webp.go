@@ -0,0 +1,518 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"math/bits"
+)
+
+// Neither x/image nor the libvips bindings write WebP; encodeWebP writes lossless ones (VP8L). It keeps to
+// what pays off on derivatives: the subtract green transform, the predictor transform with a predictor
+// chosen for each tile, and backward references to the pixel on the left or above, which take care of
+// flat areas. It uses neither a color cache nor more than one set of prefix codes.
+
+const (
+	vp8lSignature    = 0x2f
+	vp8lMaxSize      = 1 << 14
+	vp8lTileBits     = 4 // predictor tiles of 16x16 pixels
+	vp8lLiteralCodes = 256
+	vp8lLengthCodes  = 24
+	vp8lDistCodes    = 40
+	vp8lMaxLength    = 4096 // longest backward reference
+	vp8lMinLength    = 3    // shorter runs are cheaper as literals
+)
+
+// vp8lCodeLengthOrder is the order the lengths of the code length code are written in
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// vp8lPredictors are the predictors tiles choose from: L, T, the average of L and T, select and
+// the two clamped gradients
+var vp8lPredictors = []int{1, 2, 7, 11, 12, 13}
+
+func encodeWebP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	if b.Dx() < 1 || b.Dy() < 1 || b.Dx() > vp8lMaxSize || b.Dy() > vp8lMaxSize {
+		return errors.New("webp: image size out of range")
+	}
+	width, height := b.Dx(), b.Dy()
+
+	// VP8L codes colors without premultiplied alpha, its pixels are laid out as image.NRGBA ones
+	src := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	opaque := src.Opaque()
+
+	// Subtract green: red and blue are coded as their difference to green, which they follow closely
+	pix := src.Pix
+	for p := 0; p < len(pix); p += 4 {
+		pix[p+0] -= pix[p+1]
+		pix[p+2] -= pix[p+1]
+	}
+	tilesW := (width + 1<<vp8lTileBits - 1) >> vp8lTileBits
+	modes, residuals := vp8lPredict(pix, width, height)
+
+	e := &vp8lWriter{}
+	e.writeBits(vp8lSignature, 8)
+	e.writeBits(uint32(width-1), 14)
+	e.writeBits(uint32(height-1), 14)
+	if opaque {
+		e.writeBits(0, 1)
+	} else {
+		e.writeBits(1, 1)
+	}
+	e.writeBits(0, 3) // version
+
+	// Transforms are listed in the order they're applied in, decoders undo them backwards
+	e.writeBits(1, 1)
+	e.writeBits(2, 2) // subtract green
+	e.writeBits(1, 1)
+	e.writeBits(0, 2) // predictor
+	e.writeBits(vp8lTileBits-2, 3)
+	e.writeImage(modes, tilesW, false)
+	e.writeBits(0, 1)
+
+	e.writeImage(residuals, width, true)
+	data := e.bytes()
+
+	// RIFF container, holding the single VP8L chunk padded to an even size
+	size := len(data) + len(data)&1
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+size))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if len(data) < size {
+		data = append(data, 0)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// vp8lPredict picks the predictor leaving the smallest residuals in each tile; it returns the predictors
+// as an image of tiles, holding them in green, and the residuals of every pixel
+func vp8lPredict(pix []byte, width, height int) (modes, residuals []byte) {
+	tile := 1 << vp8lTileBits
+	tilesW := (width + tile - 1) / tile
+	tilesH := (height + tile - 1) / tile
+	modes = make([]byte, 4*tilesW*tilesH)
+	residuals = make([]byte, len(pix))
+
+	for ty := 0; ty < tilesH; ty++ {
+		for tx := 0; tx < tilesW; tx++ {
+			x0, y0 := tx*tile, ty*tile
+			x1, y1 := minInt(x0+tile, width), minInt(y0+tile, height)
+
+			best, bestCost := 0, -1
+			for _, mode := range vp8lPredictors {
+				cost := 0
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						p := 4 * (y*width + x)
+						pred := vp8lPrediction(pix, width, x, y, mode)
+						for c := 0; c < 4; c++ {
+							d := int(int8(pix[p+c] - pred[c]))
+							if d < 0 {
+								d = -d
+							}
+							cost += d
+						}
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+
+			modes[4*(ty*tilesW+tx)+1] = byte(best)
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					p := 4 * (y*width + x)
+					pred := vp8lPrediction(pix, width, x, y, best)
+					for c := 0; c < 4; c++ {
+						residuals[p+c] = pix[p+c] - pred[c]
+					}
+				}
+			}
+		}
+	}
+	return modes, residuals
+}
+
+// vp8lPrediction predicts the pixel at x, y out of its neighbors with a predictor of vp8lPredictors;
+// the first pixel is predicted opaque black, the rest of the first row by L and of the first column by T
+func vp8lPrediction(pix []byte, width, x, y, mode int) [4]byte {
+	switch {
+	case x == 0 && y == 0:
+		return [4]byte{0, 0, 0, 0xff}
+	case y == 0:
+		mode = 1
+	case x == 0:
+		mode = 2
+	}
+
+	// The top right neighbor of the last column is the first pixel of the current row
+	var l, t, tl [4]byte
+	p := 4 * (y*width + x)
+	if x > 0 {
+		copy(l[:], pix[p-4:p])
+	}
+	if y > 0 {
+		copy(t[:], pix[p-4*width:])
+	}
+	if x > 0 && y > 0 {
+		copy(tl[:], pix[p-4*width-4:])
+	}
+
+	if mode == 11 {
+		// Select: L or T, whichever is closer to the gradient L + T - TL
+		var distL, distT int
+		for c := 0; c < 4; c++ {
+			distL += absInt(int(t[c]) - int(tl[c]))
+			distT += absInt(int(l[c]) - int(tl[c]))
+		}
+		if distL < distT {
+			return l
+		}
+		return t
+	}
+
+	var pred [4]byte
+	for c := 0; c < 4; c++ {
+		switch mode {
+		case 1:
+			pred[c] = l[c]
+		case 2:
+			pred[c] = t[c]
+		case 7:
+			pred[c] = byte((int(l[c]) + int(t[c])) / 2)
+		case 12:
+			pred[c] = byte(clampInt(int(l[c])+int(t[c])-int(tl[c]), 0, 255))
+		case 13:
+			avg := (int(l[c]) + int(t[c])) / 2
+			pred[c] = byte(clampInt(avg+(avg-int(tl[c]))/2, 0, 255))
+		}
+	}
+	return pred
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// vp8lParse splits an image into literal pixels and runs repeating the pixel on the left or above,
+// handed to fn with their length and distance code; literals have a zero length
+func vp8lParse(pix []byte, width int, fn func(i, length, distCode int)) {
+	n := len(pix) / 4
+	refs := [2]struct{ dist, code int }{{1, 2}, {width, 1}}
+	for i := 0; i < n; {
+		length, distCode := 0, 0
+		for _, ref := range refs {
+			if ref.dist > i {
+				continue
+			}
+			l := 0
+			for l < vp8lMaxLength && i+l < n && vp8lSamePixel(pix, i+l, i+l-ref.dist) {
+				l++
+			}
+			if l > length {
+				length, distCode = l, ref.code
+			}
+		}
+		if length < vp8lMinLength {
+			fn(i, 0, 0)
+			i++
+			continue
+		}
+		fn(i, length, distCode)
+		i += length
+	}
+}
+
+func vp8lSamePixel(pix []byte, i, j int) bool {
+	return pix[4*i] == pix[4*j] && pix[4*i+1] == pix[4*j+1] && pix[4*i+2] == pix[4*j+2] && pix[4*i+3] == pix[4*j+3]
+}
+
+// vp8lPrefix splits a backward reference length or distance code into its prefix symbol and extra bits
+func vp8lPrefix(v int) (symbol int, extra uint32, n uint) {
+	v--
+	if v < 4 {
+		return v, 0, 0
+	}
+	high := bits.Len(uint(v)) - 1
+	n = uint(high - 1)
+	return 2*high + v>>n&1, uint32(v) & (1<<n - 1), n
+}
+
+// vp8lWriter packs bits from the least significant one up, as VP8L is read
+type vp8lWriter struct {
+	buf   []byte
+	bits  uint64
+	nbits uint
+}
+
+func (e *vp8lWriter) writeBits(bits uint32, n uint) {
+	e.bits |= uint64(bits&(1<<n-1)) << e.nbits
+	e.nbits += n
+	for e.nbits >= 8 {
+		e.buf = append(e.buf, byte(e.bits))
+		e.bits >>= 8
+		e.nbits -= 8
+	}
+}
+
+// emit writes a prefix code; codes are read one bit at a time, so their bits are stored reversed
+func (e *vp8lWriter) emit(code huffmanCode) {
+	e.writeBits(code.bits, uint(code.size))
+}
+
+// bytes flushes the last bits and returns what was written
+func (e *vp8lWriter) bytes() []byte {
+	if e.nbits > 0 {
+		e.buf = append(e.buf, byte(e.bits))
+		e.bits, e.nbits = 0, 0
+	}
+	return e.buf
+}
+
+// writeImage entropy codes an image: the main one, or one of the tiles of a transform
+func (e *vp8lWriter) writeImage(pix []byte, width int, main bool) {
+	e.writeBits(0, 1) // no color cache
+	if main {
+		e.writeBits(0, 1) // a single set of prefix codes
+	}
+
+	// The prefix codes are derived from the frequencies of the symbols, counted on a first pass
+	green := make([]int, vp8lLiteralCodes+vp8lLengthCodes)
+	red := make([]int, vp8lLiteralCodes)
+	blue := make([]int, vp8lLiteralCodes)
+	alpha := make([]int, vp8lLiteralCodes)
+	dist := make([]int, vp8lDistCodes)
+	vp8lParse(pix, width, func(i, length, distCode int) {
+		if length == 0 {
+			green[pix[4*i+1]]++
+			red[pix[4*i]]++
+			blue[pix[4*i+2]]++
+			alpha[pix[4*i+3]]++
+			return
+		}
+		symbol, _, _ := vp8lPrefix(length)
+		green[vp8lLiteralCodes+symbol]++
+		symbol, _, _ = vp8lPrefix(distCode)
+		dist[symbol]++
+	})
+
+	greenCodes := e.writeCode(green)
+	redCodes := e.writeCode(red)
+	blueCodes := e.writeCode(blue)
+	alphaCodes := e.writeCode(alpha)
+	distCodes := e.writeCode(dist)
+	vp8lParse(pix, width, func(i, length, distCode int) {
+		if length == 0 {
+			e.emit(greenCodes[pix[4*i+1]])
+			e.emit(redCodes[pix[4*i]])
+			e.emit(blueCodes[pix[4*i+2]])
+			e.emit(alphaCodes[pix[4*i+3]])
+			return
+		}
+		symbol, extra, n := vp8lPrefix(length)
+		e.emit(greenCodes[vp8lLiteralCodes+symbol])
+		e.writeBits(extra, n)
+		symbol, extra, n = vp8lPrefix(distCode)
+		e.emit(distCodes[symbol])
+		e.writeBits(extra, n)
+	})
+}
+
+// writeCode writes the prefix code of an alphabet built out of the counts of its symbols and returns it
+func (e *vp8lWriter) writeCode(counts []int) []huffmanCode {
+	codes := make([]huffmanCode, len(counts))
+	var used []int
+	for symbol, count := range counts {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+
+	// Simple codes hold up to two symbols below 256; a single symbol takes no bits at all
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		e.writeBits(1, 1)
+		e.writeBits(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			e.writeBits(0, 1)
+			e.writeBits(uint32(used[0]), 1)
+		} else {
+			e.writeBits(1, 1)
+			e.writeBits(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			e.writeBits(uint32(used[1]), 8)
+			codes[used[0]] = huffmanCode{bits: 0, size: 1}
+			codes[used[1]] = huffmanCode{bits: 1, size: 1}
+		}
+		return codes
+	}
+
+	e.writeBits(0, 1)
+	lengths := vp8lCodeLengths(counts, 15)
+	e.writeCodeLengths(lengths)
+	return vp8lCodes(lengths)
+}
+
+// writeCodeLengths writes the code lengths of an alphabet, themselves prefix coded;
+// runs of zeros are coded as 17 (3 to 10 of them) and 18 (11 to 138)
+func (e *vp8lWriter) writeCodeLengths(lengths []uint8) {
+	type token struct {
+		symbol int
+		extra  uint32
+	}
+	var tokens []token
+	counts := make([]int, len(vp8lCodeLengthOrder))
+	for i := 0; i < len(lengths); {
+		run := 0
+		for i+run < len(lengths) && lengths[i+run] == 0 && run < 138 {
+			run++
+		}
+		t := token{symbol: int(lengths[i])}
+		switch {
+		case run >= 11:
+			t = token{symbol: 18, extra: uint32(run - 11)}
+			i += run
+		case run >= 3:
+			t = token{symbol: 17, extra: uint32(run - 3)}
+			i += run
+		default:
+			i++
+		}
+		tokens = append(tokens, t)
+		counts[t.symbol]++
+	}
+
+	codeLengths := vp8lCodeLengths(counts, 7)
+	n := len(vp8lCodeLengthOrder)
+	for n > 4 && codeLengths[vp8lCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	e.writeBits(uint32(n-4), 4)
+	for _, symbol := range vp8lCodeLengthOrder[:n] {
+		e.writeBits(uint32(codeLengths[symbol]), 3)
+	}
+	e.writeBits(0, 1) // lengths are given for the whole alphabet
+
+	codes := vp8lCodes(codeLengths)
+	for _, t := range tokens {
+		e.emit(codes[t.symbol])
+		switch t.symbol {
+		case 17:
+			e.writeBits(t.extra, 3)
+		case 18:
+			e.writeBits(t.extra, 7)
+		}
+	}
+}
+
+// vp8lCodeLengths computes the lengths of the Huffman codes of symbols out of their counts, flattening
+// the counts until no code is longer than limit. A lone symbol gets a length of 1, as lengths of 0 mean
+// unused symbols; it is coded with no bits though.
+func vp8lCodeLengths(counts []int, limit int) []uint8 {
+	lengths := make([]uint8, len(counts))
+	weights := make([]int, 0, 2*len(counts))
+	var symbols []int
+	for symbol, count := range counts {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+			weights = append(weights, count)
+		}
+	}
+	if len(symbols) == 1 {
+		lengths[symbols[0]] = 1
+		return lengths
+	}
+
+	for {
+		// Merge the two lightest nodes until a single tree is left
+		weights = weights[:len(symbols)]
+		parents := make([]int, len(symbols), 2*len(symbols))
+		live := make([]int, len(symbols))
+		for i := range live {
+			live[i] = i
+			parents[i] = -1
+		}
+		for len(live) > 1 {
+			var lightest [2]int
+			for k := range lightest {
+				j := 0
+				for i := range live {
+					if weights[live[i]] < weights[live[j]] {
+						j = i
+					}
+				}
+				lightest[k] = live[j]
+				live = append(live[:j], live[j+1:]...)
+			}
+			node := len(weights)
+			weights = append(weights, weights[lightest[0]]+weights[lightest[1]])
+			parents = append(parents, -1)
+			parents[lightest[0]], parents[lightest[1]] = node, node
+			live = append(live, node)
+		}
+
+		longest := 0
+		for i, symbol := range symbols {
+			depth := 0
+			for j := i; parents[j] >= 0; j = parents[j] {
+				depth++
+			}
+			lengths[symbol] = uint8(depth)
+			longest = maxInt(longest, depth)
+		}
+		if longest <= limit {
+			return lengths
+		}
+		for i := range symbols {
+			weights[i] = (weights[i] + 1) / 2
+		}
+	}
+}
+
+// vp8lCodes assigns the canonical codes of the given lengths, their bits reversed for emit
+func vp8lCodes(lengths []uint8) []huffmanCode {
+	codes := make([]huffmanCode, len(lengths))
+	var used, symbol int
+	var counts [16]uint32
+	for s, length := range lengths {
+		if length > 0 {
+			counts[length]++
+			used++
+			symbol = s
+		}
+	}
+	if used == 1 {
+		codes[symbol] = huffmanCode{}
+		return codes
+	}
+
+	var next [16]uint32
+	code := uint32(0)
+	for length := 1; length < len(next); length++ {
+		code = (code + counts[length-1]) << 1
+		next[length] = code
+	}
+	for s, length := range lengths {
+		if length > 0 {
+			codes[s] = huffmanCode{bits: bits.Reverse32(next[length]) >> (32 - length), size: length}
+			next[length]++
+		}
+	}
+	return codes
+}
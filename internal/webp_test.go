@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func Test_encodeWebP(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	noise := func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256))}
+	}
+	gradient := func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(x * 3), uint8(y * 5), uint8(x + y), 255}
+	}
+	// A logo: a disc on a transparent background, flat enough for backward references
+	logo := func(x, y int) color.NRGBA {
+		if (x-40)*(x-40)+(y-30)*(y-30) < 400 {
+			return color.NRGBA{200, 30, 60, 255}
+		}
+		return color.NRGBA{}
+	}
+
+	tests := []struct {
+		name   string
+		width  int
+		height int
+		fill   func(x, y int) color.NRGBA
+	}{
+		{"pixel", 1, 1, gradient},
+		{"column", 1, 37, gradient},
+		{"row", 37, 1, gradient},
+		{"noise", 53, 29, noise},
+		{"gradient", 80, 60, gradient},
+		{"logo", 80, 60, logo},
+	}
+
+	for _, tt := range tests {
+		src := image.NewNRGBA(image.Rect(0, 0, tt.width, tt.height))
+		for y := 0; y < tt.height; y++ {
+			for x := 0; x < tt.width; x++ {
+				src.SetNRGBA(x, y, tt.fill(x, y))
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := encodeWebP(&buf, src); err != nil {
+			t.Errorf("%s: failed to encode image: %s", tt.name, err)
+			continue
+		}
+		dst, err := webp.Decode(&buf)
+		if err != nil {
+			t.Errorf("%s: failed to decode image: %s", tt.name, err)
+			continue
+		}
+		if dst.Bounds() != src.Bounds() {
+			t.Errorf("%s: expected bounds: %v, got bounds: %v", tt.name, src.Bounds(), dst.Bounds())
+			continue
+		}
+		if n, ok := dst.(*image.NRGBA); !ok || !bytes.Equal(n.Pix, src.Pix) {
+			t.Errorf("%s: expected the pixels of the original back", tt.name)
+		}
+	}
+
+	if err := encodeWebP(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, 20000, 1))); err == nil {
+		t.Error("expected an error encoding an image wider than VP8L allows")
+	}
+}